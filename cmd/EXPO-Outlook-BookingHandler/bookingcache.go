@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/rs/zerolog/log"
+)
+
+// syncMargin is subtracted from the time of the last sync, so bookings updated while it ran or a clock that is a
+// bit off on the EXPO side are not missed. Fetching a booking twice does no harm
+const syncMargin = 5 * time.Minute
+
+// BookingCache keeps the EXPO bookings of the last full sync by ID. In incremental mode the runs until the next full
+// sync only fetch the bookings updated since the last one and merge them in, which cuts the EXPO load of frequent
+// runs. Deleted bookings stay until the next full sync replaces the cache, up to Sync.FullInterval, cancelled ones
+// are updated and filtered out by their state
+type BookingCache struct {
+	mutex        sync.Mutex
+	bookings     map[int]QueryUserResponseBookingNode
+	from         time.Time // The window of the last full sync
+	to           time.Time
+	lastSync     time.Time
+	lastFullSync time.Time
+	incremental  bool // Cleared when EXPO does not accept the updated bookings query
+}
+
+func NewBookingCache() *BookingCache {
+	return &BookingCache{incremental: true}
+}
+
+// Bookings returns the bookings with events in the window. Inside the cached window only the updated bookings are
+// fetched. Windows outside the cached one, an empty cache and every Sync.FullInterval fetch the whole window, which
+// only replaces the cache when full is set, like for the full window of a check
+func (cache *BookingCache) Bookings(ctx context.Context, config *EXPOConfig, from time.Time, to time.Time, full bool) ([]QueryUserResponseBookingNode, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	covered := cache.bookings != nil && !from.Before(cache.from) && !to.After(cache.to)
+	fresh := time.Since(cache.lastFullSync) < config.Sync.FullInterval
+	if config.Sync.Mode == "incremental" && cache.incremental && covered && fresh {
+		started := time.Now()
+		since := cache.lastSync.Add(-syncMargin)
+		updated, err := fetchUpdatedBookings(ctx, config, since)
+		if stale := updatedBefore(updated, since); err == nil && stale != nil {
+			// An EXPO that ignores the search returns every booking, so deleted ones would never be dropped
+			log.Ctx(ctx).Warn().Msgf("EXPO sync: Booking %s was not updated since %s, EXPO seems to ignore the search for updated bookings, using full syncs from now on", stale.HumanNumber, since.Format(time.RFC3339))
+			cache.incremental = false
+		} else if err == nil || errors.Is(err, errIncompleteFetch) {
+			for _, booking := range updated {
+				cache.bookings[booking.ID] = booking
+			}
+			if err != nil {
+				// lastSync is kept, so the next sync fetches the missing updates again
+				return cache.values(), err
+			}
+			cache.lastSync = started
+			expoSyncs.WithLabelValues("incremental").Inc()
+			log.Ctx(ctx).Info().Msgf("EXPO sync: %d bookings updated since the last sync, %d cached", len(updated), len(cache.bookings))
+			return cache.values(), nil
+		} else if expoErrorType(err) != "graphql" {
+			return nil, err
+		} else {
+			// The search for updated bookings is not supported, fall back to full syncs until the next restart
+			log.Ctx(ctx).Warn().Msgf("EXPO sync: The updated bookings query failed, using full syncs from now on: %v", err)
+			cache.incremental = false
+		}
+	}
+	started := time.Now()
+	bookings, err := fetchBookingWindow(ctx, config, from, to)
+	if err != nil {
+		// An incomplete fetch does not replace the cache, the next run does a full sync again
+		return bookings, err
+	}
+	expoSyncs.WithLabelValues("full").Inc()
+	if !full {
+		// A narrowed window would leave the cache without the bookings of the rest of the full window
+		log.Ctx(ctx).Debug().Msgf("EXPO sync: Fetched %d bookings outside the cached window", len(bookings))
+		return bookings, nil
+	}
+	cache.bookings = make(map[int]QueryUserResponseBookingNode, len(bookings))
+	for _, booking := range bookings {
+		cache.bookings[booking.ID] = booking
+	}
+	cache.from, cache.to = from, to
+	cache.lastSync, cache.lastFullSync = started, started
+	log.Ctx(ctx).Info().Msgf("EXPO sync: Full sync, %d bookings cached", len(cache.bookings))
+	return bookings, nil
+}
+
+// updatedBefore returns the first booking last updated before since, nil if there is none. Bookings without an
+// updatedAt, like from a query that does not select it, are not counted
+func updatedBefore(bookings []QueryUserResponseBookingNode, since time.Time) *QueryUserResponseBookingNode {
+	for i, booking := range bookings {
+		if !booking.UpdatedAt.IsZero() && booking.UpdatedAt.Before(since) {
+			return &bookings[i]
+		}
+	}
+	return nil
+}
+
+// values returns the cached bookings ordered by ID, so runs see them in a stable order
+func (cache *BookingCache) values() []QueryUserResponseBookingNode {
+	bookings := make([]QueryUserResponseBookingNode, 0, len(cache.bookings))
+	for _, booking := range cache.bookings {
+		bookings = append(bookings, booking)
+	}
+	sort.Slice(bookings, func(i, j int) bool { return bookings[i].ID < bookings[j].ID })
+	return bookings
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+	log "github.com/rs/zerolog/log"
+)
+
+// Exit codes of the subcommands
+const (
+	exitOK    = 0 // Everything worked
+	exitError = 1 // Some part failed, like a single calendar, or validate found problems
+	exitFatal = 2 // Nothing could be checked, like a broken config or EXPO being unreachable
+)
+
+type command struct {
+	name        string
+	description string
+	run         func(args []string) int
+}
+
+var commands = []command{
+	{"run", "Check for overlaps on the schedule until stopped (default)", runDaemon},
+	{"check-once", "Run one check and exit, 0 on success, 1 if a calendar failed, 2 if the check failed", checkOnce},
+	{"validate", "Check config.yaml with the env variable overrides and the email templates", validate},
+	{"list-bookings", "Print the EXPO bookings of the monitored resources", listBookings},
+	{"list-events", "Print the parsed events of a calendar", listEvents},
+	{"test-mail", "Send a sample conflict email to an address", testMail},
+}
+
+func findCommand(name string) (command, bool) {
+	for _, command := range commands {
+		if command.name == name {
+			return command, true
+		}
+	}
+	return command{}, false
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: EXPO-Outlook-BookingHandler [command] [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", command.name, command.description)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun a command with -h to see its flags.")
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+// checkOnce runs one check of the full window, or of the next -horizon, and prints a summary
+func checkOnce(args []string) int {
+	flags := newFlagSet("check-once")
+	configPath := flags.String("config", "config.yaml", "path to config.yaml")
+	horizon := flags.Duration("horizon", 0, "only check from now until this far ahead, like 48h, instead of the full window")
+	dryRun := flags.Bool("dry-run", false, "write the conflict report instead of sending emails, like DryRun.Enabled")
+	report := flags.String("report", "", "where the dry run report is written, - for stdout, default DryRun.Path")
+	reportFormat := flags.String("report-format", "", "json, csv or html, default DryRun.Format")
+	summary := flags.String("summary", "text", "summary printed after the check: text or json")
+	wait := flags.Duration("wait", 0, "how long to wait when another instance is running a check, by default exit with 2 right away")
+	if err := flags.Parse(args); err != nil {
+		return exitFatal
+	}
+	if *summary != "text" && *summary != "json" {
+		fmt.Fprintf(os.Stderr, "invalid -summary: %s, must be text or json\n", *summary)
+		return exitFatal
+	}
+	cfg, version, err := setup(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+	if *dryRun {
+		cfg.DryRun.Enabled = true
+	}
+	if *report != "" {
+		cfg.DryRun.Path = *report
+	}
+	switch *reportFormat {
+	case "":
+	case "json", "csv", "html":
+		cfg.DryRun.Format = *reportFormat
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -report-format: %s, must be json, csv or html\n", *reportFormat)
+		return exitFatal
+	}
+	expoConfigs, err := SetupEXPOSources(cfg.EXPO, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+	if err := checkSMTP(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to log in to the SMTP server:", err)
+		return exitFatal
+	}
+	SetupTimezones(cfg.ICS.TimezoneMappings)
+	fetcher := NewICSFetcher(cfg.ICS.Fetch, version)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	tier := fullTier
+	if *horizon > 0 {
+		tier = cfghelper.TierConfig{Name: "next " + horizon.String(), Horizon: *horizon}
+	}
+	runCtx, cancel := context.WithTimeout(withRunID(ctx), cfg.Run.Timeout)
+	defer cancel()
+	lockCtx, cancelLock := context.WithTimeout(runCtx, *wait)
+	defer cancelLock()
+	// The state is loaded under the lock, since another instance may be saving it
+	status, err := lockedCheck(runCtx, lockCtx, tier, expoConfigs, fetcher, cfg, true)
+	if err != nil {
+		status = RunStatus{ID: runIDFrom(runCtx), Window: tier.Name, StartedAt: time.Now(), Error: err.Error()}
+	}
+	// Keep stdout for the report when it is written there
+	summaryOut := os.Stdout
+	if cfg.DryRun.Enabled && cfg.DryRun.Path == "-" {
+		summaryOut = os.Stderr
+	}
+	if *summary == "json" {
+		printRunSummaryJSON(summaryOut, status)
+	} else {
+		printRunSummary(summaryOut, status)
+	}
+	return exitCodeFor(status)
+}
+
+// exitCodeFor maps a run to the exit code of check-once
+func exitCodeFor(status RunStatus) int {
+	if !status.EXPO.Success || status.Error != "" {
+		return exitFatal
+	}
+	if status.EXPO.Incomplete || len(status.NotifyErrors) > 0 {
+		return exitError
+	}
+	for _, calendar := range status.Calendars {
+		if !calendar.Success {
+			return exitError
+		}
+	}
+	return exitOK
+}
+
+// RunSummary is the -summary json output of check-once
+type RunSummary struct {
+	RunStatus
+	Result   string `json:"result"` // success, partial or failed
+	ExitCode int    `json:"exitCode"`
+}
+
+func printRunSummaryJSON(out io.Writer, status RunStatus) {
+	summary := RunSummary{RunStatus: status, ExitCode: exitCodeFor(status)}
+	summary.Result = []string{exitOK: "success", exitError: "partial", exitFatal: "failed"}[summary.ExitCode]
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(summary)
+}
+
+func printRunSummary(out io.Writer, status RunStatus) {
+	// A run that could not start, like when the lock is taken, only has its error
+	if !status.WindowStart.IsZero() {
+		fmt.Fprintf(out, "Window: %s, %s to %s\n", status.Window, status.WindowStart.Format(time.RFC3339), status.WindowEnd.Format(time.RFC3339))
+	}
+	if len(status.EXPOSources) == 0 {
+		printEXPOStatus(out, "EXPO", status.EXPO)
+	}
+	for _, source := range status.EXPOSources {
+		printEXPOStatus(out, "EXPO "+source.Name, source)
+	}
+	for _, calendar := range status.Calendars {
+		if calendar.Success {
+			fmt.Fprintf(out, "Calendar %s: %d events\n", calendar.Name, calendar.Events)
+		} else {
+			fmt.Fprintf(out, "Calendar %s: failed: %s\n", calendar.Name, calendar.Error)
+		}
+	}
+	fmt.Fprintf(out, "Conflicts: %d found, %d notified\n", status.ConflictsFound, status.ConflictsNotified)
+	for _, notifyError := range status.NotifyErrors {
+		fmt.Fprintf(out, "Notification failed: %s\n", notifyError)
+	}
+	switch exitCodeFor(status) {
+	case exitOK:
+		fmt.Fprintf(out, "Result: success in %s\n", status.Duration)
+	case exitError:
+		fmt.Fprintf(out, "Result: partial failure in %s\n", status.Duration)
+	default:
+		fmt.Fprintf(out, "Result: failed in %s: %s\n", status.Duration, status.Error)
+	}
+}
+
+func printEXPOStatus(out io.Writer, label string, status EXPOStatus) {
+	if status.Incomplete {
+		fmt.Fprintf(out, "%s: %d bookings, incomplete: %s\n", label, status.Bookings, status.Error)
+	} else if status.Success {
+		fmt.Fprintf(out, "%s: %d bookings\n", label, status.Bookings)
+	} else if status.Error != "" {
+		fmt.Fprintf(out, "%s: failed: %s\n", label, status.Error)
+	}
+}
+
+// validate reports every problem it finds instead of stopping at the first one
+func validate(args []string) int {
+	flags := newFlagSet("validate")
+	configPath := flags.String("config", "config.yaml", "path to config.yaml")
+	checkLogin := flags.Bool("smtp", false, "also log in to the SMTP server when emails are sent")
+	if err := flags.Parse(args); err != nil {
+		return exitFatal
+	}
+	cfg, _, err := setup(*configPath)
+	if err != nil {
+		// Load reports every problem in config.yaml, print them one by one
+		var configErr interface{ Errors() []string }
+		if errors.As(err, &configErr) {
+			for _, problem := range configErr.Errors() {
+				fmt.Println("Problem:", problem)
+			}
+		} else {
+			fmt.Println("Problem:", err)
+		}
+		return exitError
+	}
+	// The config, including the env variable overrides, EXPO and SMTP settings and templates, is checked by Load
+	var problems []string
+	if cfg.Email.Subject == "" {
+		problems = append(problems, "Email.Subject is empty")
+	}
+	for i, source := range cfg.EXPO.Instances() {
+		field := "EXPO"
+		if len(cfg.EXPO.Sources) > 0 {
+			field = fmt.Sprintf("EXPO.Sources[%d]", i)
+		}
+		if _, err := loadQuery(source.QueryFile, defaultQuery, queryVariables(windowQueryVariables, source.Pagination)); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.QueryFile: %v", field, err))
+		}
+		if _, err := loadQuery(source.Sync.QueryFile, defaultUpdatedQuery, queryVariables(updatedQueryVariables, source.Pagination)); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.Sync.QueryFile: %v", field, err))
+		}
+	}
+	if _, err := os.Stat(dataDir); err != nil {
+		problems = append(problems, fmt.Sprintf("Storage.DataDir: %v", err))
+	}
+	if *checkLogin {
+		if err := checkSMTP(cfg); err != nil {
+			problems = append(problems, fmt.Sprintf("SMTP login: %v", err))
+		}
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println("Problem:", problem)
+		}
+		return exitError
+	}
+	fmt.Printf("OK: %d calendars, %d email mappings\n", len(cfg.ICS.Calendars), len(cfg.Email.Mappings))
+	return exitOK
+}
+
+// listBookings prints the EXPO bookings in the window, filtered like a check unless -all is set
+func listBookings(args []string) int {
+	flags := newFlagSet("list-bookings")
+	configPath := flags.String("config", "config.yaml", "path to config.yaml")
+	from := flags.String("from", "", "first day (2006-01-02), default yesterday")
+	to := flags.String("to", "", "last day (2006-01-02), default the end of the month")
+	all := flags.Bool("all", false, "also list bookings that are not confirmed or not on a monitored resource")
+	sourceName := flags.String("source", "", "name of the EXPO source, required with several sources")
+	if err := flags.Parse(args); err != nil {
+		return exitFatal
+	}
+	cfg, _, err := setup(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+	instances := cfg.EXPO.Instances()
+	index := 0
+	if *sourceName != "" {
+		index = slices.IndexFunc(instances, func(source cfghelper.EXPOSettings) bool { return strings.EqualFold(source.Name, *sourceName) })
+		if index < 0 {
+			fmt.Fprintf(os.Stderr, "unknown EXPO source: %s\n", *sourceName)
+			return exitFatal
+		}
+	} else if len(instances) > 1 {
+		fmt.Fprintln(os.Stderr, "-source is required with several EXPO sources")
+		return exitFatal
+	}
+	source := instances[index]
+	expoConfig, err := SetupEXPO(source)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+	ctx := context.Background()
+	start, end, err := parseDateRange(ctx, *from, *to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+	exitCode := exitOK
+	bookings, err := GetNewBookings(ctx, expoConfig, start, end, true)
+	if errors.Is(err, errIncompleteFetch) {
+		fmt.Fprintln(os.Stderr, "Warning, the list is incomplete:", err)
+		exitCode = exitError
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to fetch EXPO bookings:", err)
+		return exitFatal
+	}
+	if !*all {
+		var monitoredResources []string
+		for _, calendar := range cfg.ICS.Calendars {
+			if calendar.EXPOSource == source.Name {
+				monitoredResources = append(monitoredResources, calendar.EXPOResourceName)
+			}
+		}
+		bookings = filterBookings(ctx, bookings, source.Filters, monitoredResources)
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "BOOKING\tSTATE\tTYPE\tEVENT\tSTART\tEND\tRESOURCES")
+	for _, booking := range bookings {
+		for _, reservation := range booking.Reservations.Nodes {
+			occupancy, ok := reservation.Occupancy()
+			if !ok {
+				fmt.Fprintf(out, "%s\t%s\t%s\t-\t-\t-\t-\n", booking.HumanNumber, booking.State, reservationType(reservation))
+				continue
+			}
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", booking.HumanNumber, booking.State, reservationType(reservation), occupancy.Name,
+				occupancy.StartAt.Local().Format(time.DateTime), occupancy.EndAt.Local().Format(time.DateTime), strings.Join(occupancy.Resources, ", "))
+		}
+	}
+	out.Flush()
+	fmt.Printf("%d bookings\n", len(bookings))
+	return exitCode
+}
+
+// listEvents prints the events of one calendar as the check sees them
+func listEvents(args []string) int {
+	flags := newFlagSet("list-events")
+	configPath := flags.String("config", "config.yaml", "path to config.yaml")
+	name := flags.String("calendar", "", "name of the calendar in config.yaml (required)")
+	from := flags.String("from", "", "first day (2006-01-02), default yesterday")
+	to := flags.String("to", "", "last day (2006-01-02), default the end of the month")
+	if err := flags.Parse(args); err != nil {
+		return exitFatal
+	}
+	cfg, version, err := setup(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+	var calendar *cfghelper.CalendarConfig
+	for i := range cfg.ICS.Calendars {
+		if strings.EqualFold(cfg.ICS.Calendars[i].Name, *name) {
+			calendar = &cfg.ICS.Calendars[i]
+		}
+	}
+	if calendar == nil {
+		fmt.Fprintf(os.Stderr, "Calendar %q not found, use -calendar with one of:\n", *name)
+		for _, calendar := range cfg.ICS.Calendars {
+			fmt.Fprintln(os.Stderr, " ", calendar.Name)
+		}
+		return exitFatal
+	}
+	ctx := context.Background()
+	start, end, err := parseDateRange(ctx, *from, *to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+	SetupTimezones(cfg.ICS.TimezoneMappings)
+	fetcher := NewICSFetcher(cfg.ICS.Fetch, version)
+	fetchCtx, cancel := context.WithTimeout(ctx, cfg.ICS.Fetch.Timeout)
+	defer cancel()
+	events, err := GetCalendarEventsFromICS(fetchCtx, fetcher, calendar, start, end)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to fetch calendar:", err)
+		return exitError
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "START\tEND\tSUMMARY\tSTATUS\tTRANSP\tBUSY-STATUS\tCONFLICT\tUID")
+	for _, event := range events {
+		counts := "no"
+		if event.CountsAsConflict(cfg.ICS.ConflictRules) {
+			counts = "yes"
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", event.Start.Local().Format(time.DateTime), event.End.Local().Format(time.DateTime),
+			event.Summary, orDash(event.Status), orDash(event.Transparency), orDash(event.BusyStatus), counts, event.UID)
+	}
+	out.Flush()
+	fmt.Printf("%d events\n", len(events))
+	return exitOK
+}
+
+// testMail renders the conflict email for a made up overlap and sends it, even if SendEmails is false
+func testMail(args []string) int {
+	flags := newFlagSet("test-mail")
+	configPath := flags.String("config", "config.yaml", "path to config.yaml")
+	to := flags.String("to", "", "address to send the sample to (required)")
+	fallback := flags.Bool("fallback", false, "send the fallback email instead")
+	if err := flags.Parse(args); err != nil {
+		return exitFatal
+	}
+	if *to == "" {
+		fmt.Fprintln(os.Stderr, "-to is required")
+		return exitFatal
+	}
+	cfg, _, err := setup(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+	subject, content := "[Test] "+cfg.Email.Subject, cfg.Email.MailContent
+	if *fallback {
+		subject, content = subject+"-Fallback", cfg.Email.FallbackContent()
+	}
+	htmlContent, err := formatContentHTML(content, sampleOverlap(cfg))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Run.MailTimeout)
+	defer cancel()
+	if err := deliverEmail(ctx, cfg.SMTP, *to, subject, htmlContent, cfg.Email); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to send test email:", err)
+		return exitError
+	}
+	fmt.Printf("Test email sent to %s\n", *to)
+	return exitOK
+}
+
+// sampleOverlap is a made up overlap on the first calendar, used to render the templates
+func sampleOverlap(cfg *cfghelper.Config) Overlap {
+	start := time.Now().Add(24 * time.Hour).Truncate(time.Hour)
+	overlap := Overlap{
+		expoHumanNumber: "TEST-1",
+		expoEventName:   "Test event",
+		expoStartTime:   start,
+		expoEndTime:     start.Add(2 * time.Hour),
+		icsUID:          "test-uid",
+		icsSummary:      "Test Summary",
+		icsStartTime:    start.Add(time.Hour),
+		icsEndTime:      start.Add(3 * time.Hour),
+	}
+	if len(cfg.ICS.Calendars) > 0 {
+		overlap.resourceName = cfg.ICS.Calendars[0].EXPOResourceName
+		overlap.icsName = cfg.ICS.Calendars[0].Name
+		overlap.expoSource = cfg.ICS.Calendars[0].EXPOSource
+	}
+	if source, err := sourceSettings(cfg, overlap.expoSource); err == nil {
+		overlap.expoBookingURL = source.URL + "/administration/bookings/0"
+	}
+	return overlap
+}
+
+// parseDateRange turns the -from and -to flags into a window, the default is the one from GetMonthDateRange
+func parseDateRange(ctx context.Context, from string, to string) (time.Time, time.Time, error) {
+	start, end := GetMonthDateRange(ctx)
+	if from != "" {
+		day, err := time.ParseInLocation(time.DateOnly, from, time.Local)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid -from: %w", err)
+		}
+		start = day
+	}
+	if to != "" {
+		day, err := time.ParseInLocation(time.DateOnly, to, time.Local)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid -to: %w", err)
+		}
+		end = day.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	if !end.After(start) {
+		return start, end, fmt.Errorf("the end of the window must be after the start")
+	}
+	log.Ctx(ctx).Printf("Window from %s to %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	return start, end, nil
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExitCodeFor(t *testing.T) {
+	ok := EXPOStatus{Success: true, Bookings: 3}
+	calendars := []CalendarStatus{{Name: "Room", Success: true, Events: 2}}
+	tests := []struct {
+		name   string
+		status RunStatus
+		want   int
+	}{
+		{"success", RunStatus{EXPO: ok, Calendars: calendars}, exitOK},
+		{"no calendars", RunStatus{EXPO: ok}, exitOK},
+		{"calendar failed", RunStatus{EXPO: ok, Calendars: append(calendars, CalendarStatus{Name: "Hall", Error: "timeout"})}, exitError},
+		{"bookings incomplete", RunStatus{EXPO: EXPOStatus{Success: true, Incomplete: true, Error: "page limit"}, Calendars: calendars}, exitError},
+		{"notification failed", RunStatus{EXPO: ok, Calendars: calendars, ConflictsFound: 2, ConflictsNotified: 1, NotifyErrors: []string{"booking B-1 in calendar Room: smtp: 421"}}, exitError},
+		{"EXPO failed", RunStatus{EXPO: EXPOStatus{Error: "unauthorized"}, Error: "failed to fetch EXPO bookings"}, exitFatal},
+		{"run error", RunStatus{EXPO: ok, Calendars: calendars, Error: "context deadline exceeded"}, exitFatal},
+		{"lock taken", RunStatus{Error: "data directory is locked"}, exitFatal},
+	}
+	for _, test := range tests {
+		if got := exitCodeFor(test.status); got != test.want {
+			t.Errorf("%s: exitCodeFor() = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRunSummaryNotifyErrors(t *testing.T) {
+	status := RunStatus{EXPO: EXPOStatus{Success: true}, ConflictsFound: 1, NotifyErrors: []string{"booking B-1 in calendar Room: smtp: 421"}}
+	var out bytes.Buffer
+	printRunSummary(&out, status)
+	for _, want := range []string{"Notification failed: booking B-1 in calendar Room: smtp: 421", "Result: partial failure"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("summary %q does not contain %q", out.String(), want)
+		}
+	}
+	out.Reset()
+	printRunSummaryJSON(&out, status)
+	if !strings.Contains(out.String(), `"result": "partial"`) || !strings.Contains(out.String(), `"notifyErrors"`) {
+		t.Errorf("JSON summary %s, want a partial result with the notification errors", out.String())
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/rs/zerolog/log"
+)
+
+// CheckWindow is the period a run checks, a full run covers GetMonthDateRange and a tier run the near future
+type CheckWindow struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+	Full  bool
+}
+
+type Conflict struct {
+	Overlap   Overlap
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// ConflictStore is the conflict state shared by all runs, each run updates the part inside its window
+type ConflictStore struct {
+	mutex     sync.Mutex
+	conflicts map[string]*Conflict
+}
+
+var conflictState = NewConflictStore()
+
+func NewConflictStore() *ConflictStore {
+	return &ConflictStore{conflicts: make(map[string]*Conflict)}
+}
+
+// Recurring events share their UID, so the start time is part of the key. Booking numbers are only unique in one
+// EXPO installation, so the source is too when it has a name
+func conflictKey(overlap Overlap) string {
+	key := fmt.Sprintf("%s|%s|%s", overlap.icsUID, overlap.icsStartTime.UTC().Format(time.RFC3339), overlap.expoHumanNumber)
+	if overlap.expoSource != "" {
+		key += "|" + overlap.expoSource
+	}
+	return key
+}
+
+// Update stores the conflicts found by a run. Known conflicts inside the window that were not found again are resolved,
+// except for calendars that could not be fetched in this run
+func (store *ConflictStore) Update(ctx context.Context, window CheckWindow, found []Overlap, failedCalendars map[string]bool) (added int, resolved int) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, overlap := range found {
+		key := conflictKey(overlap)
+		seen[key] = true
+		if conflict, ok := store.conflicts[key]; ok {
+			conflict.Overlap = overlap
+			conflict.LastSeen = now
+			continue
+		}
+		store.conflicts[key] = &Conflict{Overlap: overlap, FirstSeen: now, LastSeen: now}
+		added++
+	}
+	for key, conflict := range store.conflicts {
+		overlap := conflict.Overlap
+		if seen[key] || failedCalendars[overlap.icsName] {
+			continue
+		}
+		if overlap.icsStartTime.Before(window.End) && overlap.icsEndTime.After(window.Start) {
+			log.Ctx(ctx).Info().Msgf("Conflict resolved: EXPO Booking %s in Calendar %s with summary: %s", overlap.expoHumanNumber, overlap.icsName, overlap.icsSummary)
+			delete(store.conflicts, key)
+			resolved++
+		}
+	}
+	return added, resolved
+}
+
+// Count returns the number of open conflicts
+func (store *ConflictStore) Count() int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return len(store.conflicts)
+}
+
+// Snapshot returns a copy of the open conflicts, sorted by event start
+func (store *ConflictStore) Snapshot() []Conflict {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	conflicts := make([]Conflict, 0, len(store.conflicts))
+	for _, conflict := range store.conflicts {
+		conflicts = append(conflicts, *conflict)
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		if !conflicts[i].Overlap.icsStartTime.Equal(conflicts[j].Overlap.icsStartTime) {
+			return conflicts[i].Overlap.icsStartTime.Before(conflicts[j].Overlap.icsStartTime)
+		}
+		return conflictKey(conflicts[i].Overlap) < conflictKey(conflicts[j].Overlap)
+	})
+	return conflicts
+}
+
+// Restore replaces the open conflicts, used when loading the saved state
+func (store *ConflictStore) Restore(conflicts []Conflict) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.conflicts = make(map[string]*Conflict, len(conflicts))
+	for _, conflict := range conflicts {
+		store.conflicts[conflictKey(conflict.Overlap)] = &conflict
+	}
+}
@@ -3,152 +3,319 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/url"
-	"os"
+	"slices"
 	"strings"
 	"time"
 
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
 	"github.com/machinebox/graphql"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/rs/zerolog/log"
 )
 
 type EXPOConfig struct {
+	Name      string // Name of the source, empty with a single unnamed one
 	EXPOURL   string
 	EXPOToken string
 	QUERY     string
+	// How far the query window is widened, so bookings crossing the window edges are fetched too
+	MaxEventDuration time.Duration
+	UpdatedQuery     string // Query for the bookings updated since the last sync
+	Sync             cfghelper.SyncConfig
+	Pagination       cfghelper.PaginationConfig
+	cache            *BookingCache
+	settings         cfghelper.EXPOSettings // The settings it was set up with, to find out if a reload changed them
 }
 
-func SetupEXPO() (*EXPOConfig, error) {
-	var expoURL string = os.Getenv("EXPO_URL")
-	if expoURL == "" {
-		return nil, errors.New("EXPO_URL env variable not set or empty")
+// errIncompleteFetch is wrapped by the errors of a fetch that stopped before the last page or returned fewer
+// bookings than EXPO counted. The bookings fetched so far are returned with it
+var errIncompleteFetch = errors.New("incomplete EXPO fetch")
+
+// SetupEXPOSources sets up every EXPO installation in the config. A source whose connection did not change keeps its
+// EXPOConfig from previous, with the bookings it has cached
+func SetupEXPOSources(expoSettings cfghelper.EXPOSettings, previous []*EXPOConfig) ([]*EXPOConfig, error) {
+	var configs []*EXPOConfig
+	for _, source := range expoSettings.Instances() {
+		if index := slices.IndexFunc(previous, func(config *EXPOConfig) bool { return sameConnection(config.settings, source) }); index >= 0 {
+			configs = append(configs, previous[index])
+			continue
+		}
+		config, err := SetupEXPO(source)
+		if err != nil {
+			if source.Name != "" {
+				return nil, fmt.Errorf("EXPO source %s: %w", source.Name, err)
+			}
+			return nil, err
+		}
+		configs = append(configs, config)
 	}
-	log.Print("EXPO_URL: ", expoURL)
+	return configs, nil
+}
+
+// sameConnection reports if two sources fetch the same bookings, the filters are read from the config of every run
+func sameConnection(a cfghelper.EXPOSettings, b cfghelper.EXPOSettings) bool {
+	return a.Name == b.Name && a.URL == b.URL && a.Token == b.Token && a.QueryFile == b.QueryFile &&
+		a.MaxEventDuration == b.MaxEventDuration && a.Sync == b.Sync && a.Pagination == b.Pagination
+}
 
-	var expoToken string = os.Getenv("EXPO_TOKEN")
-	if expoToken == "" {
-		return nil, errors.New("EXPO_TOKEN env variable not set or empty")
+// SetupEXPO loads the booking query, the URL and token are checked when the config is loaded
+func SetupEXPO(expoSettings cfghelper.EXPOSettings) (*EXPOConfig, error) {
+	logger := log.Logger
+	if expoSettings.Name != "" {
+		logger = log.With().Str("source", expoSettings.Name).Logger()
 	}
-	log.Print("EXPO_TOKEN: ", expoToken)
+	logger.Info().Msgf("EXPO URL: %s", expoSettings.URL)
 
-	// Load the query from a file
-	queryFile, err := os.ReadFile("query-booking.graphql")
+	query, err := loadQuery(expoSettings.QueryFile, defaultQuery, queryVariables(windowQueryVariables, expoSettings.Pagination))
 	if err != nil {
-		return nil, errors.New("failed to read query file")
+		return nil, err
+	}
+	if expoSettings.QueryFile != "" {
+		logger.Info().Msgf("EXPO query: Using %s", expoSettings.QueryFile)
 	}
-	query := string(queryFile)
-	return &EXPOConfig{expoURL, expoToken, query}, nil
+	updatedQuery, err := loadQuery(expoSettings.Sync.QueryFile, defaultUpdatedQuery, queryVariables(updatedQueryVariables, expoSettings.Pagination))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info().Msgf("EXPO sync: %s, full sync at least every %s", expoSettings.Sync.Mode, expoSettings.Sync.FullInterval)
+	return &EXPOConfig{
+		Name:             expoSettings.Name,
+		EXPOURL:          expoSettings.URL,
+		EXPOToken:        expoSettings.Token.Value,
+		QUERY:            query,
+		MaxEventDuration: max(expoSettings.MaxEventDuration, 0),
+		UpdatedQuery:     updatedQuery,
+		Sync:             expoSettings.Sync,
+		Pagination:       expoSettings.Pagination,
+		cache:            NewBookingCache(),
+		settings:         expoSettings,
+	}, nil
 }
 
-func GetNewBookings(config *EXPOConfig, startTime time.Time, endTime time.Time) []QueryUserResponseBookingNode {
-	expoBookings, err := fetchEXPOBooking(config.EXPOURL, config.QUERY, startTime, endTime, config.EXPOToken)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to fetch EXPO bookings")
+// GetNewBookings returns the bookings with a reservation that overlaps the window. The EXPO search only finds
+// events that lie completely inside the window it is given, so the window is widened by MaxEventDuration on both
+// sides and the result is trimmed to the reservations overlapping the real window. The bookings come from the
+// booking cache, full reports if the window is the full window, which replaces the cached one. An incomplete fetch
+// returns the bookings fetched so far with an error wrapping errIncompleteFetch
+func GetNewBookings(ctx context.Context, config *EXPOConfig, startTime time.Time, endTime time.Time, full bool) ([]QueryUserResponseBookingNode, error) {
+	expoBookings, err := config.cache.Bookings(ctx, config, startTime.Add(-config.MaxEventDuration), endTime.Add(config.MaxEventDuration), full)
+	if err != nil && !errors.Is(err, errIncompleteFetch) {
+		return nil, err
+	}
+	if err == nil {
+		log.Ctx(ctx).Print("EXPO bookings fetched successfully")
+	}
+	return trimBookings(ctx, expoBookings, startTime, endTime), err
+}
+
+// trimBookings keeps the reservations that overlap the window, and the bookings that still have one
+func trimBookings(ctx context.Context, bookings []QueryUserResponseBookingNode, startTime time.Time, endTime time.Time) []QueryUserResponseBookingNode {
+	var trimmed []QueryUserResponseBookingNode
+	for _, booking := range bookings {
+		reservations := booking.Reservations.Nodes
+		booking.Reservations.Nodes = nil
+		for _, reservation := range reservations {
+			if occupancy, ok := reservation.Occupancy(); ok && occupancy.StartAt.Before(endTime) && occupancy.EndAt.After(startTime) {
+				booking.Reservations.Nodes = append(booking.Reservations.Nodes, reservation)
+			}
+		}
+		if len(booking.Reservations.Nodes) > 0 {
+			trimmed = append(trimmed, booking)
+		}
 	}
-	log.Print("EXPO bookings fetched successfully")
-	return expoBookings
+	log.Ctx(ctx).Debug().Msgf("Trimmed bookings to the window %s - %s: %d, removed %d bookings", startTime.Format(time.RFC3339), endTime.Format(time.RFC3339), len(trimmed), len(bookings)-len(trimmed))
+	return trimmed
 }
 
-func fetchEXPOBooking(expoURL string, query string, startDate time.Time, endDate time.Time, expoToken string) ([]QueryUserResponseBookingNode, error) {
+// fetchBookingWindow fetches every booking with events inside the window
+func fetchBookingWindow(ctx context.Context, config *EXPOConfig, from time.Time, to time.Time) ([]QueryUserResponseBookingNode, error) {
+	return fetchEXPOBooking(ctx, config.EXPOURL, config.QUERY, map[string]any{
+		"startAtGteq": from.Format(time.RFC3339),
+		"endAtLteq":   to.Format(time.RFC3339),
+	}, config.EXPOToken, config.Pagination)
+}
+
+// fetchUpdatedBookings fetches every booking updated since the given time, wherever its events are
+func fetchUpdatedBookings(ctx context.Context, config *EXPOConfig, since time.Time) ([]QueryUserResponseBookingNode, error) {
+	return fetchEXPOBooking(ctx, config.EXPOURL, config.UpdatedQuery, map[string]any{
+		"updatedAtGteq": since.Format(time.RFC3339),
+	}, config.EXPOToken, config.Pagination)
+}
+
+func fetchEXPOBooking(ctx context.Context, expoURL string, query string, variables map[string]any, expoToken string, pagination cfghelper.PaginationConfig) ([]QueryUserResponseBookingNode, error) {
+	timer := prometheus.NewTimer(expoFetchDuration)
+	defer timer.ObserveDuration()
 	var allNodes []QueryUserResponseBookingNode
 	var cursor *string
+	// The cursors already followed, a server returning one of them again would never reach the last page
+	seenCursors := make(map[string]bool)
+	totalNodeCount := 0
 	apiEndpoint := "/api/v3/graphql"
 	_, err := url.Parse(expoURL + apiEndpoint)
 	if err != nil {
-		log.Print("Error parsing EXPO URL: ", err)
+		log.Ctx(ctx).Error().Msgf("Error parsing EXPO URL: %v", err)
 		return nil, err
 	}
-	for { // Infinite loop
+	for page := 1; ; page++ {
 		client := graphql.NewClient(expoURL + apiEndpoint)
 		request := graphql.NewRequest(query)
 		request.Header.Set("Authorization", "Bearer "+expoToken)
 		request.Header.Set("Content-Type", "application/json")
-		request.Var("startAtGteq", startDate.Format(time.RFC3339))
-		request.Var("endAtLteq", endDate.Format(time.RFC3339))
+		for name, value := range variables {
+			request.Var(name, value)
+		}
 		if cursor != nil {
 			request.Var("cursor", *cursor)
 		}
+		if pagination.PageSize > 0 {
+			request.Var("first", pagination.PageSize)
+		}
 
 		var response QueryUserResponse
-		err := client.Run(context.Background(), request, &response) // TODO rewrite in standard http client to handle unauthorized errors better
+		err := client.Run(ctx, request, &response) // TODO rewrite in standard http client to handle unauthorized errors better
 		if err != nil {
-			log.Printf("Fetched, but error occurred: %v", err)
+			log.Ctx(ctx).Error().Msgf("Fetched, but error occurred: %v", err)
+			expoErrors.WithLabelValues(expoErrorType(err)).Inc()
 			return nil, err
 		}
+		expoFetchPages.Inc()
 
 		allNodes = append(allNodes, response.Bookings.Nodes...)
+		totalNodeCount = response.Bookings.TotalNodeCount
 
 		if !response.Bookings.PageInfo.HasNextPage {
-			log.Printf("Fetched %d bookings, total: %d", len(response.Bookings.Nodes), response.Bookings.TotalNodeCount)
+			log.Ctx(ctx).Printf("Fetched %d bookings, total: %d", len(response.Bookings.Nodes), response.Bookings.TotalNodeCount)
 			break
 		}
-		cursor = &response.Bookings.PageInfo.EndCursor
-		log.Printf("Fetched %d bookings, total: %d, next cursor: %s", len(response.Bookings.Nodes), response.Bookings.TotalNodeCount, *cursor)
+		next := response.Bookings.PageInfo.EndCursor
+		log.Ctx(ctx).Printf("Fetched %d bookings, total: %d, next cursor: %s", len(response.Bookings.Nodes), response.Bookings.TotalNodeCount, next)
+		var incomplete error
+		switch {
+		case next == "":
+			incomplete = fmt.Errorf("%w: page %d has a next page but no end cursor", errIncompleteFetch, page)
+		case seenCursors[next]:
+			incomplete = fmt.Errorf("%w: cursor %s of page %d was already followed", errIncompleteFetch, next, page)
+		case page >= pagination.MaxPages:
+			incomplete = fmt.Errorf("%w: stopped at the EXPO.Pagination.MaxPages limit of %d pages", errIncompleteFetch, page)
+		}
+		if incomplete != nil {
+			expoErrors.WithLabelValues(expoErrorType(incomplete)).Inc()
+			return allNodes, fmt.Errorf("%w, fetched %d of %d bookings", incomplete, len(allNodes), totalNodeCount)
+		}
+		seenCursors[next] = true
+		cursor = &next
+	}
+	if len(allNodes) < totalNodeCount {
+		err := fmt.Errorf("%w: fetched %d of %d bookings", errIncompleteFetch, len(allNodes), totalNodeCount)
+		expoErrors.WithLabelValues(expoErrorType(err)).Inc()
+		return allNodes, err
+	}
+	if len(allNodes) > totalNodeCount {
+		// Bookings created while paging can show up twice, nothing is missing
+		log.Ctx(ctx).Warn().Msgf("Fetched %d bookings, but EXPO counted %d", len(allNodes), totalNodeCount)
 	}
 
 	return allNodes, nil
 }
 
-func filterConfirmedBookings(bookings []QueryUserResponseBookingNode) []QueryUserResponseBookingNode {
+// filterBookings keeps the bookings that are checked for conflicts: the ones matching EXPO.Filters that hold a
+// monitored resource. Checks and list-bookings both use it, so they always agree
+func filterBookings(ctx context.Context, bookings []QueryUserResponseBookingNode, filters cfghelper.BookingFilters, monitoredResourceNames []string) []QueryUserResponseBookingNode {
+	return filterBookingWithResource(ctx, filterBookingsByConfig(ctx, bookings, filters), monitoredResourceNames)
+}
+
+// filterBookingsByConfig applies the state, booking type and customer type filters, and removes the reservations
+// of filtered offers. A booking without any reservations left is removed
+func filterBookingsByConfig(ctx context.Context, bookings []QueryUserResponseBookingNode, filters cfghelper.BookingFilters) []QueryUserResponseBookingNode {
 	var filteredBookings []QueryUserResponseBookingNode
 	for _, booking := range bookings {
-		if booking.State == "confirmed" {
-			filteredBookings = append(filteredBookings, booking)
+		switch {
+		case !filters.IncludesState(booking.State):
+			log.Ctx(ctx).Debug().Msgf("Booking: %s, skipped, state: %s", booking.HumanNumber, booking.State)
+			continue
+		case !filters.BookingTypes.Matches(booking.BookingType.Name):
+			log.Ctx(ctx).Debug().Msgf("Booking: %s, skipped, booking type: %s", booking.HumanNumber, booking.BookingType.Name)
+			continue
+		case !filters.CustomerTypes.Matches(booking.Booker.Customer.CustomerType.Name):
+			log.Ctx(ctx).Debug().Msgf("Booking: %s, skipped, customer type: %s", booking.HumanNumber, booking.Booker.Customer.CustomerType.Name)
+			continue
+		}
+		reservations := booking.Reservations.Nodes
+		booking.Reservations.Nodes = nil
+		for _, reservation := range reservations {
+			if filters.Offers.Matches(reservation.Offer.Name) {
+				booking.Reservations.Nodes = append(booking.Reservations.Nodes, reservation)
+			} else {
+				log.Ctx(ctx).Debug().Msgf("Booking: %s, skipped reservation of offer: %s", booking.HumanNumber, reservation.Offer.Name)
+			}
+		}
+		if len(booking.Reservations.Nodes) == 0 && len(reservations) > 0 {
+			continue
 		}
+		filteredBookings = append(filteredBookings, booking)
 	}
-	log.Printf("Filtered confirmed bookings: %d, removed %d bookings", len(filteredBookings), len(bookings)-len(filteredBookings))
+	log.Ctx(ctx).Printf("Filtered bookings by state %s and type: %d, removed %d bookings", strings.Join(filters.States, ", "), len(filteredBookings), len(bookings)-len(filteredBookings))
 	return filteredBookings
 }
 
-func filterBookingWithResource(bookings []QueryUserResponseBookingNode, monitoredResourceNames []string) []QueryUserResponseBookingNode {
+func filterBookingWithResource(ctx context.Context, bookings []QueryUserResponseBookingNode, monitoredResourceNames []string) []QueryUserResponseBookingNode {
 	var filteredBookings []QueryUserResponseBookingNode
 	seen := make(map[string]bool)
 	if len(monitoredResourceNames) == 0 {
-		log.Print("No monitored resource names found, returning all bookings")
+		log.Ctx(ctx).Print("No monitored resource names found, returning all bookings")
 		return bookings
 	}
 	for _, booking := range bookings {
 		for _, reservation := range booking.Reservations.Nodes {
-			if reservation.Reservationable != nil {
-				if reservation.Reservationable.Event.EventAllocation.EventAllocationResources.TotalNodeCount > 0 {
-					for _, resource := range reservation.Reservationable.Event.EventAllocation.EventAllocationResources.Nodes {
-						for _, monResource := range monitoredResourceNames {
-							if strings.EqualFold(resource.Resource.Name, monResource) {
-								if !seen[booking.HumanNumber] {
-									filteredBookings = append(filteredBookings, booking)
-									seen[booking.HumanNumber] = true
-								}
-								break
-							}
+			occupancy, ok := reservation.Occupancy()
+			if !ok {
+				log.Ctx(ctx).Debug().Msgf("Booking: %s, has a reservation without time or resources: %s", booking.HumanNumber, reservationType(reservation))
+				continue
+			}
+			for _, resource := range occupancy.Resources {
+				for _, monResource := range monitoredResourceNames {
+					if strings.EqualFold(resource, monResource) {
+						if !seen[booking.HumanNumber] {
+							filteredBookings = append(filteredBookings, booking)
+							seen[booking.HumanNumber] = true
 						}
+						break
 					}
 				}
-			} else {
-				log.Printf("Booking: %s, has no reservationable event", booking.HumanNumber)
 			}
 		}
 	}
-	log.Printf("Filtered bookings with resources: %d, removed %d bookings", len(filteredBookings), len(bookings)-len(filteredBookings))
+	log.Ctx(ctx).Printf("Filtered bookings with resources: %d, removed %d bookings", len(filteredBookings), len(bookings)-len(filteredBookings))
 	return filteredBookings
 }
 
-func doesBookingResourceOverlap(booking QueryUserResponseBookingNode, startDate time.Time, endDate time.Time, resourceName string) (bool, string, time.Time, time.Time) {
+// reservationType names the type of a reservation for the log, like RentalReservation
+func reservationType(reservation BookingReservation) string {
+	if reservation.Reservationable == nil || reservation.Reservationable.Typename == "" {
+		return "unknown type"
+	}
+	return reservation.Reservationable.Typename
+}
+
+func doesBookingResourceOverlap(ctx context.Context, booking QueryUserResponseBookingNode, startDate time.Time, endDate time.Time, resourceName string) (bool, string, time.Time, time.Time) {
 	for _, reservation := range booking.Reservations.Nodes {
-		if reservation.Reservationable != nil {
-			if reservation.Reservationable.Event.StartAt.Before(endDate) && reservation.Reservationable.Event.EndAt.After(startDate) {
-				for _, resource := range reservation.Reservationable.Event.EventAllocation.EventAllocationResources.Nodes {
-					if resource.Resource.Name == resourceName {
-						log.Printf("Found overlap for booking: %s with booking resource: %s, Event name: %s was looking for resource: %s", booking.HumanNumber, resource.Resource.Name, reservation.Reservationable.Event.Name, resourceName)
-						return true, reservation.Reservationable.Event.Name, reservation.Reservationable.Event.StartAt, reservation.Reservationable.Event.EndAt
-					}
-				}
+		occupancy, ok := reservation.Occupancy()
+		if !ok || !occupancy.StartAt.Before(endDate) || !occupancy.EndAt.After(startDate) {
+			continue
+		}
+		for _, resource := range occupancy.Resources {
+			if resource == resourceName {
+				log.Ctx(ctx).Printf("Found overlap for booking: %s with booking resource: %s, Event name: %s was looking for resource: %s", booking.HumanNumber, resource, occupancy.Name, resourceName)
+				return true, occupancy.Name, occupancy.StartAt, occupancy.EndAt
 			}
 		}
 	}
 	return false, "Not found", time.Time{}, time.Time{}
 }
 
-type QueryUserResponseBookingNode = struct {
+type QueryUserResponseBookingNode struct {
 	HumanNumber string
 	ID          int
 	State       string
@@ -167,32 +334,87 @@ type QueryUserResponseBookingNode = struct {
 		}
 	}
 	Reservations struct {
-		Nodes []struct {
-			Offer struct {
-				Name string
-			}
-			Reservationable *struct {
-				Event struct {
-					Name            string
-					StartAt         time.Time
-					EndAt           time.Time
-					EventAllocation struct {
-						EventAllocationResources struct {
-							TotalNodeCount int
-							Nodes          []struct {
-								Resource struct {
-									Name         string
-									ResourceType struct {
-										Name string
-									}
-								}
-							}
-						}
-					}
+		Nodes []BookingReservation
+	}
+}
+
+type BookingReservation struct {
+	Offer struct {
+		Name string
+	}
+	Reservationable *Reservationable
+}
+
+// Reservationable is every reservation type that occupies resources, the fragments of the query are decoded into it.
+// Program and workshop reservations book an event with its resources, rentals book resources directly. The default
+// query only selects programs, Examples/query-booking-all-reservations.graphql adds the other types
+type Reservationable struct {
+	Typename string `json:"__typename" query:"optional"`
+	// ProgramReservation and WorkshopReservation
+	Event struct {
+		Name            string
+		StartAt         time.Time
+		EndAt           time.Time
+		EventAllocation struct {
+			EventAllocationResources struct {
+				TotalNodeCount int
+				Nodes          []struct {
+					Resource EXPOResource
 				}
 			}
 		}
 	}
+	// RentalReservation
+	Name      string    `query:"optional"`
+	StartAt   time.Time `query:"optional"`
+	EndAt     time.Time `query:"optional"`
+	Resources *struct {
+		Nodes []EXPOResource
+	} `query:"optional"`
+}
+
+type EXPOResource struct {
+	Name         string
+	ResourceType struct {
+		Name string
+	}
+}
+
+// Occupancy is the time and resources a reservation holds, whatever its type
+type Occupancy struct {
+	Name      string
+	StartAt   time.Time
+	EndAt     time.Time
+	Resources []string
+}
+
+// Occupancy returns what the reservation holds, false if it is a type that is not fetched or holds no time
+func (reservation BookingReservation) Occupancy() (Occupancy, bool) {
+	reservationable := reservation.Reservationable
+	if reservationable == nil {
+		return Occupancy{}, false
+	}
+	var occupancy Occupancy
+	if !reservationable.Event.StartAt.IsZero() {
+		event := reservationable.Event
+		occupancy = Occupancy{Name: event.Name, StartAt: event.StartAt, EndAt: event.EndAt}
+		for _, node := range event.EventAllocation.EventAllocationResources.Nodes {
+			occupancy.Resources = append(occupancy.Resources, node.Resource.Name)
+		}
+	} else if !reservationable.StartAt.IsZero() {
+		occupancy = Occupancy{Name: reservationable.Name, StartAt: reservationable.StartAt, EndAt: reservationable.EndAt}
+		if reservationable.Resources != nil {
+			for _, resource := range reservationable.Resources.Nodes {
+				occupancy.Resources = append(occupancy.Resources, resource.Name)
+			}
+		}
+	} else {
+		return Occupancy{}, false
+	}
+	if occupancy.Name == "" {
+		occupancy.Name = reservation.Offer.Name
+	}
+	return occupancy, true
 }
 
 type QueryUserResponse struct {
@@ -205,51 +427,6 @@ type QueryUserResponse struct {
 			StartCursor     string
 			HasPreviousPage bool
 		}
-		Nodes []struct {
-			HumanNumber string
-			ID          int
-			State       string
-			Email       string
-			CreatedAt   time.Time
-			UpdatedAt   time.Time
-			BookingType struct {
-				Name string
-			}
-			Booker struct {
-				Customer struct {
-					Name         string
-					CustomerType struct {
-						Name string
-					}
-				}
-			}
-			Reservations struct {
-				Nodes []struct {
-					Offer struct {
-						Name string
-					}
-					Reservationable *struct {
-						Event struct {
-							Name            string
-							StartAt         time.Time
-							EndAt           time.Time
-							EventAllocation struct {
-								EventAllocationResources struct {
-									TotalNodeCount int
-									Nodes          []struct {
-										Resource struct {
-											Name         string
-											ResourceType struct {
-												Name string
-											}
-										}
-									}
-								}
-							}
-						}
-					}
-				}
-			}
-		}
+		Nodes []QueryUserResponseBookingNode
 	}
 }
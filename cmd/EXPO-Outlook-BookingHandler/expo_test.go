@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+)
+
+// fakeEXPO serves the GraphQL endpoint of EXPO, respond returns the response to the page'th request
+type fakeEXPO struct {
+	server    *httptest.Server
+	mutex     sync.Mutex
+	variables []map[string]any // The variables of every request
+}
+
+func newFakeEXPO(t *testing.T, respond func(page int, variables map[string]any) QueryUserResponse) *fakeEXPO {
+	fake := &fakeEXPO{}
+	fake.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/graphql" {
+			http.NotFound(w, r)
+			return
+		}
+		var request struct {
+			Query     string         `json:"query"`
+			Variables map[string]any `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fake.mutex.Lock()
+		fake.variables = append(fake.variables, request.Variables)
+		page := len(fake.variables)
+		fake.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"data": respond(page, request.Variables)})
+	}))
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+func (fake *fakeEXPO) requests() []map[string]any {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return slices.Clone(fake.variables)
+}
+
+func (fake *fakeEXPO) config(pagination cfghelper.PaginationConfig) *EXPOConfig {
+	return &EXPOConfig{
+		EXPOURL:          fake.server.URL,
+		QUERY:            defaultQuery,
+		MaxEventDuration: 24 * time.Hour,
+		UpdatedQuery:     defaultUpdatedQuery,
+		Sync:             cfghelper.SyncConfig{Mode: "full", FullInterval: time.Hour},
+		Pagination:       pagination,
+		cache:            NewBookingCache(),
+	}
+}
+
+// testBooking is a booking with one program reservation of the given event
+func testBooking(id int, start time.Time, end time.Time) QueryUserResponseBookingNode {
+	booking := QueryUserResponseBookingNode{ID: id, HumanNumber: "B-" + strconv.Itoa(id), State: "confirmed"}
+	reservation := BookingReservation{Reservationable: &Reservationable{Typename: "ProgramReservation"}}
+	reservation.Reservationable.Event.Name = "Event"
+	reservation.Reservationable.Event.StartAt = start
+	reservation.Reservationable.Event.EndAt = end
+	booking.Reservations.Nodes = []BookingReservation{reservation}
+	return booking
+}
+
+// onePage is a response with all the bookings and no next page
+func onePage(bookings ...QueryUserResponseBookingNode) QueryUserResponse {
+	var response QueryUserResponse
+	response.Bookings.Nodes = bookings
+	response.Bookings.TotalNodeCount = len(bookings)
+	response.Bookings.TotalPageCount = 1
+	return response
+}
+
+func bookingIDs(bookings []QueryUserResponseBookingNode) []int {
+	var ids []int
+	for _, booking := range bookings {
+		ids = append(ids, booking.ID)
+	}
+	return ids
+}
+
+func TestGetNewBookingsWidensWindow(t *testing.T) {
+	start := time.Date(2026, 11, 2, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 11, 9, 0, 0, 0, 0, time.UTC)
+	hour := time.Hour
+	crossingStart := testBooking(1, start.Add(-4*hour), start.Add(2*hour))
+	crossingEnd := testBooking(2, end.Add(-2*hour), end.Add(3*hour))
+	before := testBooking(3, start.Add(-14*hour), start.Add(-12*hour))
+	inside := testBooking(4, start.Add(48*hour), start.Add(50*hour))
+	after := testBooking(5, end, end.Add(hour))
+	// A booking with one reservation inside and one outside the window only keeps the one inside
+	twoReservations := testBooking(6, start.Add(24*hour), start.Add(26*hour))
+	twoReservations.Reservations.Nodes = append(twoReservations.Reservations.Nodes, testBooking(6, end.Add(2*hour), end.Add(4*hour)).Reservations.Nodes...)
+	fake := newFakeEXPO(t, func(page int, variables map[string]any) QueryUserResponse {
+		return onePage(crossingStart, crossingEnd, before, inside, after, twoReservations)
+	})
+	config := fake.config(cfghelper.PaginationConfig{MaxPages: 100})
+
+	bookings, err := GetNewBookings(context.Background(), config, start, end, true)
+	if err != nil {
+		t.Fatalf("GetNewBookings returned error: %v", err)
+	}
+	requests := fake.requests()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	if got, want := requests[0]["startAtGteq"], start.Add(-config.MaxEventDuration).Format(time.RFC3339); got != want {
+		t.Errorf("startAtGteq = %v, want %s", got, want)
+	}
+	if got, want := requests[0]["endAtLteq"], end.Add(config.MaxEventDuration).Format(time.RFC3339); got != want {
+		t.Errorf("endAtLteq = %v, want %s", got, want)
+	}
+	if got, want := bookingIDs(bookings), []int{1, 2, 4, 6}; !slices.Equal(got, want) {
+		t.Errorf("bookings = %v, want %v", got, want)
+	}
+	for _, booking := range bookings {
+		if booking.ID == 6 && len(booking.Reservations.Nodes) != 1 {
+			t.Errorf("booking 6 has %d reservations, want the 1 inside the window", len(booking.Reservations.Nodes))
+		}
+	}
+}
+
+func TestTrimBookingsEdges(t *testing.T) {
+	start := time.Date(2026, 11, 2, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 11, 9, 0, 0, 0, 0, time.UTC)
+	bookings := []QueryUserResponseBookingNode{
+		testBooking(1, start.Add(-time.Hour), start.Add(time.Minute)),
+		testBooking(2, end.Add(-time.Minute), end.Add(time.Hour)),
+		testBooking(3, start.Add(-time.Hour), start),
+		testBooking(4, end, end.Add(time.Hour)),
+		testBooking(5, start.Add(-time.Hour), end.Add(time.Hour)),
+	}
+	if got, want := bookingIDs(trimBookings(context.Background(), bookings, start, end)), []int{1, 2, 5}; !slices.Equal(got, want) {
+		t.Errorf("trimBookings() = %v, want %v", got, want)
+	}
+}
+
+func TestBookingCacheOnlyFilledByFullWindow(t *testing.T) {
+	now := time.Now().Truncate(time.Hour)
+	fake := newFakeEXPO(t, func(page int, variables map[string]any) QueryUserResponse {
+		return onePage(testBooking(1, now.Add(time.Hour), now.Add(2*time.Hour)))
+	})
+	config := fake.config(cfghelper.PaginationConfig{MaxPages: 100})
+	config.Sync.Mode = "incremental"
+	ctx := context.Background()
+
+	// A narrowed window on an empty cache, like a tier running before the first full check, is not cached
+	if _, err := config.cache.Bookings(ctx, config, now, now.Add(48*time.Hour), false); err != nil {
+		t.Fatalf("Bookings returned error: %v", err)
+	}
+	if config.cache.bookings != nil {
+		t.Fatal("a narrowed window filled the empty cache")
+	}
+	if _, err := config.cache.Bookings(ctx, config, now, now.Add(30*24*time.Hour), true); err != nil {
+		t.Fatalf("Bookings returned error: %v", err)
+	}
+	if len(config.cache.bookings) != 1 || !config.cache.to.Equal(now.Add(30*24*time.Hour)) {
+		t.Fatalf("the full window did not fill the cache, cached %d bookings up to %s", len(config.cache.bookings), config.cache.to)
+	}
+	// Inside the cached window only the updated bookings are fetched
+	if _, err := config.cache.Bookings(ctx, config, now, now.Add(48*time.Hour), false); err != nil {
+		t.Fatalf("Bookings returned error: %v", err)
+	}
+	requests := fake.requests()
+	if _, ok := requests[len(requests)-1]["updatedAtGteq"]; !ok || len(requests) != 3 {
+		t.Errorf("requests = %v, want the third one to fetch the updated bookings", requests)
+	}
+}
+
+func TestBookingCacheFullSyncDropsDeleted(t *testing.T) {
+	now := time.Now().Truncate(time.Hour)
+	var deleted atomic.Bool
+	fake := newFakeEXPO(t, func(page int, variables map[string]any) QueryUserResponse {
+		if deleted.Load() {
+			return onePage(testBooking(1, now.Add(time.Hour), now.Add(2*time.Hour)))
+		}
+		return onePage(testBooking(1, now.Add(time.Hour), now.Add(2*time.Hour)), testBooking(2, now.Add(time.Hour), now.Add(2*time.Hour)))
+	})
+	config := fake.config(cfghelper.PaginationConfig{MaxPages: 100})
+	config.Sync.Mode = "incremental"
+	ctx := context.Background()
+	if _, err := config.cache.Bookings(ctx, config, now, now.Add(48*time.Hour), true); err != nil {
+		t.Fatalf("Bookings returned error: %v", err)
+	}
+	// Booking 2 is deleted in EXPO, the full sync after FullInterval drops it
+	deleted.Store(true)
+	config.cache.lastFullSync = now.Add(-2 * config.Sync.FullInterval)
+	bookings, err := config.cache.Bookings(ctx, config, now, now.Add(48*time.Hour), true)
+	if err != nil {
+		t.Fatalf("Bookings returned error: %v", err)
+	}
+	if got := bookingIDs(bookings); !slices.Equal(got, []int{1}) || len(config.cache.bookings) != 1 {
+		t.Errorf("bookings after the full sync = %v, %d cached, want only booking 1", got, len(config.cache.bookings))
+	}
+}
+
+func TestBookingCacheIgnoredUpdatedSearch(t *testing.T) {
+	now := time.Now().Truncate(time.Hour)
+	fake := newFakeEXPO(t, func(page int, variables map[string]any) QueryUserResponse {
+		// Every booking is returned, whatever updatedAtGteq says
+		booking := testBooking(1, now.Add(time.Hour), now.Add(2*time.Hour))
+		booking.UpdatedAt = now.Add(-30 * 24 * time.Hour)
+		return onePage(booking)
+	})
+	config := fake.config(cfghelper.PaginationConfig{MaxPages: 100})
+	config.Sync.Mode = "incremental"
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := config.cache.Bookings(ctx, config, now, now.Add(48*time.Hour), true); err != nil {
+			t.Fatalf("Bookings %d returned error: %v", i+1, err)
+		}
+	}
+	if config.cache.incremental {
+		t.Error("the cache still uses incremental syncs after EXPO ignored the search")
+	}
+	var updatedSearches int
+	for _, request := range fake.requests() {
+		if _, ok := request["updatedAtGteq"]; ok {
+			updatedSearches++
+		}
+	}
+	// The second run finds the ignored search and fetches the whole window, the third one only that
+	if requests := fake.requests(); len(requests) != 4 || updatedSearches != 1 {
+		t.Errorf("requests = %v, want one search for updated bookings between full fetches", requests)
+	}
+}
+
+// pagedResponse is a page with two bookings out of the total EXPO counts, the next page is behind endCursor
+func pagedResponse(page int, total int, hasNextPage bool, endCursor string) QueryUserResponse {
+	start := time.Date(2026, 11, 2, 10, 0, 0, 0, time.UTC)
+	response := onePage(testBooking(page*2-1, start, start.Add(time.Hour)), testBooking(page*2, start, start.Add(time.Hour)))
+	response.Bookings.TotalNodeCount = total
+	response.Bookings.PageInfo.HasNextPage = hasNextPage
+	response.Bookings.PageInfo.EndCursor = endCursor
+	return response
+}
+
+func TestFetchPagination(t *testing.T) {
+	tests := []struct {
+		name       string
+		pagination cfghelper.PaginationConfig
+		respond    func(page int, variables map[string]any) QueryUserResponse
+		requests   int
+		bookings   int
+		incomplete bool
+	}{
+		{
+			name:       "all pages",
+			pagination: cfghelper.PaginationConfig{MaxPages: 100},
+			respond: func(page int, variables map[string]any) QueryUserResponse {
+				return pagedResponse(page, 6, page < 3, "cursor-"+strconv.Itoa(page))
+			},
+			requests: 3,
+			bookings: 6,
+		},
+		{
+			name:       "MaxPages",
+			pagination: cfghelper.PaginationConfig{MaxPages: 2},
+			respond: func(page int, variables map[string]any) QueryUserResponse {
+				return pagedResponse(page, 10, true, "cursor-"+strconv.Itoa(page))
+			},
+			requests:   2,
+			bookings:   4,
+			incomplete: true,
+		},
+		{
+			name:       "repeated cursor",
+			pagination: cfghelper.PaginationConfig{MaxPages: 100},
+			respond: func(page int, variables map[string]any) QueryUserResponse {
+				return pagedResponse(page, 10, true, "cursor-1")
+			},
+			requests:   2,
+			bookings:   4,
+			incomplete: true,
+		},
+		{
+			name:       "next page without end cursor",
+			pagination: cfghelper.PaginationConfig{MaxPages: 100},
+			respond: func(page int, variables map[string]any) QueryUserResponse {
+				return pagedResponse(page, 10, true, "")
+			},
+			requests:   1,
+			bookings:   2,
+			incomplete: true,
+		},
+		{
+			name:       "fewer bookings than counted",
+			pagination: cfghelper.PaginationConfig{MaxPages: 100},
+			respond: func(page int, variables map[string]any) QueryUserResponse {
+				return pagedResponse(page, 5, false, "")
+			},
+			requests:   1,
+			bookings:   2,
+			incomplete: true,
+		},
+		{
+			name:       "more bookings than counted",
+			pagination: cfghelper.PaginationConfig{MaxPages: 100},
+			respond: func(page int, variables map[string]any) QueryUserResponse {
+				return pagedResponse(page, 1, false, "")
+			},
+			requests: 1,
+			bookings: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeEXPO(t, test.respond)
+			config := fake.config(test.pagination)
+			now := time.Now()
+			bookings, err := fetchBookingWindow(context.Background(), config, now, now.Add(time.Hour))
+			if test.incomplete != errors.Is(err, errIncompleteFetch) || (!test.incomplete && err != nil) {
+				t.Errorf("fetchBookingWindow returned error %v, want incomplete %v", err, test.incomplete)
+			}
+			if len(bookings) != test.bookings {
+				t.Errorf("got %d bookings, want %d", len(bookings), test.bookings)
+			}
+			if requests := fake.requests(); len(requests) != test.requests {
+				t.Errorf("got %d requests, want %d", len(requests), test.requests)
+			}
+		})
+	}
+}
+
+func TestFetchPaginationVariables(t *testing.T) {
+	fake := newFakeEXPO(t, func(page int, variables map[string]any) QueryUserResponse {
+		return pagedResponse(page, 4, page < 2, "cursor-"+strconv.Itoa(page))
+	})
+	now := time.Now()
+	if _, err := fetchBookingWindow(context.Background(), fake.config(cfghelper.PaginationConfig{PageSize: 2, MaxPages: 100}), now, now.Add(time.Hour)); err != nil {
+		t.Fatalf("fetchBookingWindow returned error: %v", err)
+	}
+	requests := fake.requests()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+	for i, request := range requests {
+		// JSON numbers are decoded as float64
+		if request["first"] != float64(2) {
+			t.Errorf("request %d: first = %v, want 2", i+1, request["first"])
+		}
+	}
+	if cursor, ok := requests[0]["cursor"]; ok && cursor != nil {
+		t.Errorf("request 1: cursor = %v, want none", cursor)
+	}
+	if requests[1]["cursor"] != "cursor-1" {
+		t.Errorf("request 2: cursor = %v, want cursor-1", requests[1]["cursor"])
+	}
+}
+
+// reservationsResponse has a booking of every reservation type, shaped like the response to
+// Examples/query-booking-all-reservations.graphql
+const reservationsResponse = `{"bookings": {"nodes": [
+	{"humanNumber": "B-1", "reservations": {"nodes": [{"offer": {"name": "Robotics"}, "reservationable": {
+		"__typename": "WorkshopReservation",
+		"event": {"name": "Robotics workshop", "startAt": "2026-10-20T09:00:00Z", "endAt": "2026-10-20T11:00:00Z",
+			"eventAllocation": {"eventAllocationResources": {"nodes": [{"resource": {"name": "Lab"}}]}}}}}]}},
+	{"humanNumber": "B-2", "reservations": {"nodes": [{"offer": {"name": "Hall rental"}, "reservationable": {
+		"__typename": "RentalReservation", "startAt": "2026-10-20T13:00:00Z", "endAt": "2026-10-20T17:00:00Z",
+		"resources": {"nodes": [{"name": "Hall"}]}}}]}},
+	{"humanNumber": "B-3", "reservations": {"nodes": [{"offer": {"name": "Lunch"}, "reservationable": {
+		"__typename": "FoodReservation"}}]}}
+]}}`
+
+func TestReservationTypesConflict(t *testing.T) {
+	var response QueryUserResponse
+	if err := json.Unmarshal([]byte(reservationsResponse), &response); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bookings := filterBookingWithResource(ctx, response.Bookings.Nodes, []string{"Lab", "Hall"})
+	if len(bookings) != 2 {
+		t.Fatalf("filterBookingWithResource() kept %d bookings, want the workshop and the rental", len(bookings))
+	}
+	tests := []struct {
+		booking  QueryUserResponseBookingNode
+		resource string
+		start    string
+		wantName string
+	}{
+		{bookings[0], "Lab", "2026-10-20T10:00:00Z", "Robotics workshop"},
+		{bookings[1], "Hall", "2026-10-20T16:00:00Z", "Hall rental"}, // A rental without a name uses the offer
+	}
+	for _, test := range tests {
+		start, _ := time.Parse(time.RFC3339, test.start)
+		overlap, name, _, _ := doesBookingResourceOverlap(ctx, test.booking, start, start.Add(time.Hour), test.resource)
+		if !overlap || name != test.wantName {
+			t.Errorf("%s: doesBookingResourceOverlap() = %v, %q, want an overlap with %q", test.booking.HumanNumber, overlap, name, test.wantName)
+		}
+		overlap, _, _, _ = doesBookingResourceOverlap(ctx, test.booking, start.Add(-24*time.Hour), start.Add(-23*time.Hour), test.resource)
+		if overlap {
+			t.Errorf("%s: doesBookingResourceOverlap() the day before = true, want false", test.booking.HumanNumber)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+	log "github.com/rs/zerolog/log"
+)
+
+// ICSFetcher downloads ICS feeds with timeouts, a size limit and ETag/Last-Modified caching
+type ICSFetcher struct {
+	userAgent   string
+	mutex       sync.Mutex // Guards the settings, cache and clients, Configure changes them during a reload
+	timeout     time.Duration
+	maxBodySize int64
+	cache       map[string]cachedFeed   // Per calendar name, so two calendars with the same URL keep their own copy
+	clients     map[string]*http.Client // Per calendar, since client certificates need their own transport
+}
+
+type cachedFeed struct {
+	url          string // The cached copy is only used while the calendar keeps this URL
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+func NewICSFetcher(fetchConfig cfghelper.FetchConfig, version string) *ICSFetcher {
+	return &ICSFetcher{
+		timeout:     fetchConfig.Timeout,
+		maxBodySize: fetchConfig.MaxBodySize,
+		userAgent:   "EXPO-Outlook-BookingHandler/" + strings.TrimSpace(version),
+		cache:       make(map[string]cachedFeed),
+		clients:     make(map[string]*http.Client),
+	}
+}
+
+// Configure applies new fetch settings and drops the http clients, so changed certificates are loaded again.
+// A fetch that already started keeps the settings it read
+func (fetcher *ICSFetcher) Configure(fetchConfig cfghelper.FetchConfig) {
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+	fetcher.timeout = fetchConfig.Timeout
+	fetcher.maxBodySize = fetchConfig.MaxBodySize
+	fetcher.clients = make(map[string]*http.Client)
+}
+
+// clientFor returns the http client for a calendar, with its client certificate and CA if configured
+// settings returns the timeout and size limit for a fetch
+func (fetcher *ICSFetcher) settings() (time.Duration, int64) {
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+	return fetcher.timeout, fetcher.maxBodySize
+}
+
+func (fetcher *ICSFetcher) clientFor(calConfig *cfghelper.CalendarConfig) (*http.Client, error) {
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+	if client, ok := fetcher.clients[calConfig.Name]; ok {
+		return client, nil
+	}
+	// The default transport asks for gzip and decompresses transparently, so the size limit applies to the decompressed feed
+	client := &http.Client{Timeout: fetcher.timeout}
+	auth := calConfig.Auth
+	if auth.ClientCertFile != "" || auth.CAFile != "" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if auth.ClientCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(auth.ClientCertFile, auth.ClientKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate for calendar: %s: %w", calConfig.Name, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if auth.CAFile != "" {
+			caPEM, err := os.ReadFile(auth.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA file for calendar: %s: %w", calConfig.Name, err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(caPEM) {
+				return nil, fmt.Errorf("no certificates found in CA file for calendar: %s", calConfig.Name)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client.Transport = transport
+	}
+	fetcher.clients[calConfig.Name] = client
+	return client, nil
+}
+
+type calendarResult struct {
+	events []CalendarEvent
+	err    error
+}
+
+// FetchCalendars fetches and parses all calendars with a bounded number of workers.
+// Each calendar gets its own deadline, the results are in the same order as the calendars
+func (fetcher *ICSFetcher) FetchCalendars(ctx context.Context, calendars []cfghelper.CalendarConfig, workers int, start, end time.Time) []calendarResult {
+	results := make([]calendarResult, len(calendars))
+	timeout, _ := fetcher.settings()
+	semaphore := make(chan struct{}, max(workers, 1))
+	var wg sync.WaitGroup
+	for i := range calendars {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			calCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			events, err := GetCalendarEventsFromICS(calCtx, fetcher, &calendars[i], start, end)
+			results[i] = calendarResult{events, err}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// setAuthHeaders adds basic auth, bearer token and custom headers from the calendar config
+func setAuthHeaders(req *http.Request, auth cfghelper.CalendarAuth) {
+	if auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password.Value)
+	}
+	if auth.BearerToken.Value != "" {
+		req.Header.Set("Authorization", "Bearer "+auth.BearerToken.Value)
+	}
+	for name, header := range auth.Headers {
+		req.Header.Set(name, header.Value)
+	}
+}
+
+// Fetch returns the calendar body, reusing the cached copy if the server answers 304 Not Modified
+func (fetcher *ICSFetcher) Fetch(ctx context.Context, calConfig *cfghelper.CalendarConfig) ([]byte, error) {
+	client, err := fetcher.clientFor(calConfig)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, calConfig.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for calendar: %s: %w", calConfig.Name, redactURLError(err))
+	}
+	req.Header.Set("User-Agent", fetcher.userAgent)
+	req.Header.Set("Accept", "text/calendar, */*;q=0.5")
+	setAuthHeaders(req, calConfig.Auth)
+
+	fetcher.mutex.Lock()
+	cached, hasCached := fetcher.cache[calConfig.Name]
+	maxBodySize := fetcher.maxBodySize
+	fetcher.mutex.Unlock()
+	hasCached = hasCached && cached.url == calConfig.URL
+	if hasCached {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch URL: %w for calendar: %s", redactURLError(err), calConfig.Name)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && hasCached {
+		log.Ctx(ctx).Print("ICS: Calendar not modified, using cached copy: ", calConfig.Name)
+		return cached.body, nil
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("unexpected status code: %d, check the Auth settings for calendar: %s", resp.StatusCode, calConfig.Name)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	// Read one byte more than allowed so we can tell a feed at the limit from one over it
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read calendar: %w", err)
+	}
+	if int64(len(body)) > maxBodySize {
+		return nil, fmt.Errorf("calendar is larger than the max size of %d bytes", maxBodySize)
+	}
+	if err := checkCalendarContent(resp.Header.Get("Content-Type"), body); err != nil {
+		return nil, err
+	}
+
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	fetcher.mutex.Lock()
+	if etag != "" || lastModified != "" {
+		fetcher.cache[calConfig.Name] = cachedFeed{calConfig.URL, etag, lastModified, body}
+	} else {
+		delete(fetcher.cache, calConfig.Name)
+	}
+	fetcher.mutex.Unlock()
+	return body, nil
+}
+
+// checkCalendarContent accepts any text/calendar content type, and anything else that looks like a VCALENDAR.
+// If its text/html the URL is probably wrong or expired
+func checkCalendarContent(contentType string, body []byte) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+	start := bytes.TrimSpace(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))) // Skip any UTF-8 BOM
+	if len(start) > 512 {
+		start = start[:512]
+	}
+	start = bytes.ToUpper(start)
+	looksLikeCalendar := bytes.HasPrefix(start, []byte("BEGIN:VCALENDAR"))
+	looksLikeHTML := bytes.HasPrefix(start, []byte("<!DOCTYPE HTML")) || bytes.HasPrefix(start, []byte("<HTML"))
+	switch {
+	case mediaType == "text/html" || looksLikeHTML:
+		return fmt.Errorf("unexpected content type: %s, got an HTML page, the calendar link is probably wrong or expired", contentType)
+	case !looksLikeCalendar:
+		return fmt.Errorf("unexpected content type: %s, body is not a VCALENDAR", contentType)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+)
+
+const testCalendar = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nEND:VCALENDAR\r\n"
+
+// feedServer serves testCalendar with an ETag and answers 304 to a matching If-None-Match
+type feedServer struct {
+	server      *httptest.Server
+	mutex       sync.Mutex
+	contentType string
+	body        string
+	ifNoneMatch []string // The If-None-Match header of every request
+}
+
+func newFeedServer(t *testing.T) *feedServer {
+	feed := &feedServer{contentType: "text/calendar; charset=utf-8", body: testCalendar}
+	feed.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		feed.mutex.Lock()
+		defer feed.mutex.Unlock()
+		feed.ifNoneMatch = append(feed.ifNoneMatch, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", feed.contentType)
+		w.Write([]byte(feed.body))
+	}))
+	t.Cleanup(feed.server.Close)
+	return feed
+}
+
+func (feed *feedServer) requests() []string {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	return append([]string(nil), feed.ifNoneMatch...)
+}
+
+func testFetcher() *ICSFetcher {
+	return NewICSFetcher(cfghelper.FetchConfig{Timeout: 5 * time.Second, MaxBodySize: 1024, Workers: 2}, "test")
+}
+
+func TestFetchNotModified(t *testing.T) {
+	feed := newFeedServer(t)
+	fetcher := testFetcher()
+	calendar := &cfghelper.CalendarConfig{Name: "Room", URL: feed.server.URL + "/room.ics"}
+	for i := 0; i < 2; i++ {
+		body, err := fetcher.Fetch(context.Background(), calendar)
+		if err != nil {
+			t.Fatalf("Fetch %d returned error: %v", i+1, err)
+		}
+		if string(body) != testCalendar {
+			t.Errorf("Fetch %d = %q, want the calendar", i+1, body)
+		}
+	}
+	if got := feed.requests(); len(got) != 2 || got[0] != "" || got[1] != `"v1"` {
+		t.Errorf("If-None-Match headers = %q, want none and then the ETag", got)
+	}
+}
+
+func TestFetchCacheKeyedByCalendar(t *testing.T) {
+	feed := newFeedServer(t)
+	fetcher := testFetcher()
+	room := &cfghelper.CalendarConfig{Name: "Room", URL: feed.server.URL + "/shared.ics"}
+	hall := &cfghelper.CalendarConfig{Name: "Hall", URL: feed.server.URL + "/shared.ics"}
+	for _, calendar := range []*cfghelper.CalendarConfig{room, hall} {
+		if _, err := fetcher.Fetch(context.Background(), calendar); err != nil {
+			t.Fatalf("Fetch %s returned error: %v", calendar.Name, err)
+		}
+	}
+	// A calendar whose URL changed, like after a reload, does not send the validators of the old URL
+	room.URL = feed.server.URL + "/moved.ics"
+	if _, err := fetcher.Fetch(context.Background(), room); err != nil {
+		t.Fatalf("Fetch moved calendar returned error: %v", err)
+	}
+	if got := feed.requests(); len(got) != 3 || got[1] != "" || got[2] != "" {
+		t.Errorf("If-None-Match headers = %q, want none for another calendar or a changed URL", got)
+	}
+}
+
+func TestFetchContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		wantErr     string
+	}{
+		{"text/calendar", testCalendar, ""},
+		{"application/octet-stream", "\xef\xbb\xbf" + testCalendar, ""},
+		{"text/plain", strings.ToLower(testCalendar), ""},
+		{"text/html; charset=utf-8", "<!DOCTYPE html><html></html>", "HTML page"},
+		{"text/plain", "<html><body>Sign in</body></html>", "HTML page"},
+		{"application/json", `{"error": "expired"}`, "not a VCALENDAR"},
+	}
+	for _, test := range tests {
+		feed := newFeedServer(t)
+		feed.contentType, feed.body = test.contentType, test.body
+		_, err := testFetcher().Fetch(context.Background(), &cfghelper.CalendarConfig{Name: "Room", URL: feed.server.URL})
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: Fetch returned error: %v", test.contentType, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: Fetch = %v, want an error containing %q", test.contentType, err, test.wantErr)
+		}
+	}
+}
+
+func TestFetchSizeLimit(t *testing.T) {
+	feed := newFeedServer(t)
+	fetcher := testFetcher()
+	calendar := &cfghelper.CalendarConfig{Name: "Room", URL: feed.server.URL}
+	fetcher.Configure(cfghelper.FetchConfig{Timeout: 5 * time.Second, MaxBodySize: int64(len(testCalendar))})
+	if _, err := fetcher.Fetch(context.Background(), calendar); err != nil {
+		t.Errorf("Fetch of a calendar at the limit returned error: %v", err)
+	}
+	fetcher.Configure(cfghelper.FetchConfig{Timeout: 5 * time.Second, MaxBodySize: int64(len(testCalendar)) - 1})
+	calendar.URL += "/other.ics" // Skip the cached copy
+	_, err := fetcher.Fetch(context.Background(), calendar)
+	if err == nil || !strings.Contains(err.Error(), "larger than the max size") {
+		t.Errorf("Fetch of a calendar over the limit = %v, want a size error", err)
+	}
+}
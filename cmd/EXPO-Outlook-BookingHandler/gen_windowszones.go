@@ -0,0 +1,79 @@
+//go:build ignore
+
+// Generates windowszones.go from the CLDR windowsZones.xml
+// Run with: go generate ./...
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"go/format"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+const windowsZonesURL = "https://raw.githubusercontent.com/unicode-org/cldr/main/common/supplemental/windowsZones.xml"
+
+type supplementalData struct {
+	Zones []struct {
+		Other     string `xml:"other,attr"`
+		Territory string `xml:"territory,attr"`
+		Type      string `xml:"type,attr"`
+	} `xml:"windowsZones>mapTimezones>mapZone"`
+}
+
+func main() {
+	resp, err := http.Get(windowsZonesURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var data supplementalData
+	if err := xml.Unmarshal(buf, &data); err != nil {
+		log.Fatal(err)
+	}
+	// Territory 001 is the golden zone for each Windows zone, the first IANA name is the canonical one
+	zones := make(map[string]string)
+	for _, zone := range data.Zones {
+		if zone.Territory == "001" {
+			zones[zone.Other] = strings.Fields(zone.Type)[0]
+		}
+	}
+	names := make([]string, 0, len(zones))
+	for name := range zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out bytes.Buffer
+	fmt.Fprintln(&out, "// Code generated by gen_windowszones.go; DO NOT EDIT.")
+	fmt.Fprintln(&out, "// Based on information from "+windowsZonesURL)
+	fmt.Fprintln(&out)
+	fmt.Fprintln(&out, "package main")
+	fmt.Fprintln(&out)
+	fmt.Fprintln(&out, "// windowsZones maps Windows timezone names, as used in Outlook TZIDs, to IANA timezone names")
+	fmt.Fprintln(&out, "var windowsZones = map[string]string{")
+	for _, name := range names {
+		fmt.Fprintf(&out, "\t%q: %q,\n", name, zones[name])
+	}
+	fmt.Fprintln(&out, "}")
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("windowszones.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
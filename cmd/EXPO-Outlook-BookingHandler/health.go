@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"slices"
+	"sync"
+	"time"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+	log "github.com/rs/zerolog/log"
+)
+
+// How many event counts are kept per calendar for the trend
+const eventCountHistory = 10
+
+type CalendarHealth struct {
+	Name                string    `json:"name"`
+	LastSuccess         time.Time `json:"lastSuccess,omitzero"`
+	LastError           string    `json:"lastError"`
+	UnhealthySince      time.Time `json:"unhealthySince,omitzero"` // Zero while the calendar is healthy
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	EventCounts         []int     `json:"eventCounts"`      // Oldest first
+	EmptyAfterEvents    bool      `json:"emptyAfterEvents"` // Returns no events since it had events, kept when the history only holds zeros
+	Alerted             bool      `json:"alerted"`
+}
+
+// HealthTracker keeps the health of every calendar between check runs
+type HealthTracker struct {
+	mutex     sync.Mutex
+	calendars map[string]*CalendarHealth
+}
+
+var calendarHealth = NewHealthTracker()
+
+func NewHealthTracker() *HealthTracker {
+	return &HealthTracker{calendars: make(map[string]*CalendarHealth)}
+}
+
+func (tracker *HealthTracker) get(name string) *CalendarHealth {
+	health, ok := tracker.calendars[name]
+	if !ok {
+		health = &CalendarHealth{Name: name}
+		tracker.calendars[name] = health
+	}
+	return health
+}
+
+// RecordSuccess stores a successful fetch, a sudden drop to zero events counts as unhealthy if the anomaly check is on.
+// A negative eventCount leaves the event count trend alone
+func (tracker *HealthTracker) RecordSuccess(ctx context.Context, name string, eventCount int, cfg *cfghelper.Config) {
+	tracker.mutex.Lock()
+	recovered, alerted := tracker.recordSuccess(ctx, name, eventCount, cfg)
+	tracker.mutex.Unlock()
+	// Alerts are sent without holding the lock, so a slow mail server does not block /status or the other calendars
+	if alerted {
+		sendHealthAlert(ctx, recovered, cfg, true)
+	}
+}
+
+// recordSuccess updates the health of a calendar, it returns a copy of the health to send a recovery alert for
+func (tracker *HealthTracker) recordSuccess(ctx context.Context, name string, eventCount int, cfg *cfghelper.Config) (CalendarHealth, bool) {
+	health := tracker.get(name)
+	if eventCount < 0 {
+		health.LastSuccess = time.Now()
+		health.ConsecutiveFailures = 0
+		return CalendarHealth{}, false
+	}
+	previousCount := -1
+	if len(health.EventCounts) > 0 {
+		previousCount = health.EventCounts[len(health.EventCounts)-1]
+	}
+	health.EventCounts = append(health.EventCounts, eventCount)
+	if len(health.EventCounts) > eventCountHistory {
+		health.EventCounts = health.EventCounts[len(health.EventCounts)-eventCountHistory:]
+	}
+	if previousCount >= 0 && previousCount != eventCount {
+		log.Ctx(ctx).Printf("Health: Calendar %s event count changed from %d to %d", name, previousCount, eventCount)
+	}
+	health.LastSuccess = time.Now()
+	health.ConsecutiveFailures = 0
+	if cfg.Health.ZeroEventsAnomaly && eventCount == 0 && (health.EmptyAfterEvents || hadEvents(health.EventCounts)) {
+		health.EmptyAfterEvents = true
+		health.LastError = "calendar returned no events, but had events before"
+		log.Ctx(ctx).Warn().Msgf("Health: Calendar %s returned no events, but had events before", name)
+		if health.UnhealthySince.IsZero() {
+			health.UnhealthySince = time.Now()
+		}
+		return CalendarHealth{}, false
+	}
+	var recovered CalendarHealth
+	alerted := false
+	if !health.UnhealthySince.IsZero() {
+		log.Ctx(ctx).Info().Msgf("Health: Calendar %s is healthy again after %s", name, time.Since(health.UnhealthySince).Round(time.Second))
+		recovered, alerted = health.copy(), health.Alerted
+	}
+	health.LastError = ""
+	health.UnhealthySince = time.Time{}
+	health.Alerted = false
+	health.EmptyAfterEvents = false
+	return recovered, alerted
+}
+
+// hadEvents reports if any count before the latest one was above zero
+func hadEvents(eventCounts []int) bool {
+	for _, count := range eventCounts[:len(eventCounts)-1] {
+		if count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (tracker *HealthTracker) RecordFailure(ctx context.Context, name string, err error) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	health := tracker.get(name)
+	health.ConsecutiveFailures++
+	health.LastError = err.Error()
+	if health.UnhealthySince.IsZero() {
+		health.UnhealthySince = time.Now()
+	}
+	log.Ctx(ctx).Warn().Msgf("Health: Calendar %s failed %d times in a row", name, health.ConsecutiveFailures)
+}
+
+// CheckAlerts sends an alert for every calendar that has been unhealthy longer than the threshold
+func (tracker *HealthTracker) CheckAlerts(ctx context.Context, cfg *cfghelper.Config) {
+	tracker.mutex.Lock()
+	var due []CalendarHealth
+	for _, health := range tracker.calendars {
+		if health.UnhealthySince.IsZero() || health.Alerted || time.Since(health.UnhealthySince) < cfg.Health.AlertAfter {
+			continue
+		}
+		log.Ctx(ctx).Warn().Msgf("Health: Calendar %s has been unhealthy since %s: %s", health.Name, health.UnhealthySince.Format(time.RFC3339), health.LastError)
+		due = append(due, health.copy())
+	}
+	tracker.mutex.Unlock()
+	for _, alert := range due {
+		if !sendHealthAlert(ctx, alert, cfg, false) {
+			continue
+		}
+		tracker.mutex.Lock()
+		// Only mark the calendar if it did not recover or get removed while the alert was sent
+		if health, ok := tracker.calendars[alert.Name]; ok && health.UnhealthySince.Equal(alert.UnhealthySince) {
+			health.Alerted = true
+		}
+		tracker.mutex.Unlock()
+	}
+}
+
+// Prune drops the health of calendars that are no longer configured, like after a reload
+func (tracker *HealthTracker) Prune(names []string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	for name := range tracker.calendars {
+		if !slices.Contains(names, name) {
+			delete(tracker.calendars, name)
+		}
+	}
+}
+
+func (health *CalendarHealth) copy() CalendarHealth {
+	copied := *health
+	copied.EventCounts = append([]int(nil), health.EventCounts...)
+	return copied
+}
+
+// Snapshot returns a copy of the health of all calendars
+func (tracker *HealthTracker) Snapshot() []CalendarHealth {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	snapshot := make([]CalendarHealth, 0, len(tracker.calendars))
+	for _, health := range tracker.calendars {
+		snapshot = append(snapshot, health.copy())
+	}
+	return snapshot
+}
+
+// Restore replaces the health of all calendars, used when loading the saved state
+func (tracker *HealthTracker) Restore(calendars []CalendarHealth) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.calendars = make(map[string]*CalendarHealth, len(calendars))
+	for _, health := range calendars {
+		tracker.calendars[health.Name] = &health
+	}
+}
+
+var healthAlertTemplate = template.Must(template.New("alert").Parse(`<html>
+<body>
+  {{if .Recovered}}<p>Calendar {{.Name}} is working again.</p>{{else}}<p>Calendar {{.Name}} has not been working since {{.UnhealthySince}}, so its room is not checked for conflicts.</p>
+  <p>Last error: {{.LastError}}</p>
+  <p>Failures in a row: {{.ConsecutiveFailures}}</p>
+  <p>If the calendar link has expired, publish the calendar again and update the URL in config.yaml.</p>{{end}}
+  <p>Last success: {{.LastSuccess}}</p>
+  <p>Recent event counts: {{.EventCounts}}</p>
+</body>
+</html>`))
+
+// sendHealthAlert emails the admin address, returns true if the alert was sent or would have been
+func sendHealthAlert(ctx context.Context, health CalendarHealth, cfg *cfghelper.Config, recovered bool) bool {
+	healthConfig := cfg.Health
+	if healthConfig.AdminEmail.Address == "" {
+		log.Ctx(ctx).Print("Health: No admin email set, not sending alert")
+		return false
+	}
+	lastSuccess := "never"
+	if !health.LastSuccess.IsZero() {
+		lastSuccess = health.LastSuccess.Format(time.RFC3339)
+	}
+	var buf bytes.Buffer
+	err := healthAlertTemplate.Execute(&buf, map[string]interface{}{
+		"Name":                health.Name,
+		"Recovered":           recovered,
+		"UnhealthySince":      health.UnhealthySince.Format(time.RFC3339),
+		"LastError":           health.LastError,
+		"ConsecutiveFailures": health.ConsecutiveFailures,
+		"LastSuccess":         lastSuccess,
+		"EventCounts":         fmt.Sprint(health.EventCounts),
+	})
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("Health: Error formatting alert: %v", err)
+		return false
+	}
+	subject := "EXPO-Outlook-BookingHandler: Calendar " + health.Name + " is not working"
+	if recovered {
+		subject = "EXPO-Outlook-BookingHandler: Calendar " + health.Name + " is working again"
+	}
+	mailSettings := cfg.Email
+	if !mailSettings.SendEmails || cfg.DryRun.Enabled {
+		log.Ctx(ctx).Info().Msgf("Health: Would have sent alert to: %s with subject: %s", healthConfig.AdminEmail.Address, subject)
+		return true
+	}
+	mailCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.Run.MailTimeout)
+	defer cancel()
+	if err := deliverEmail(mailCtx, cfg.SMTP, healthConfig.AdminEmail.Address, subject, buf.String(), mailSettings); err != nil {
+		log.Ctx(ctx).Error().Msgf("Health: Error sending alert: %v", err)
+		return false
+	}
+	log.Ctx(ctx).Info().Msgf("Health: Alert sent to: %s", healthConfig.AdminEmail.Address)
+	return true
+}
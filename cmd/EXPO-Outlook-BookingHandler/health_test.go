@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+)
+
+func TestZeroEventsAnomalyOutlastsHistory(t *testing.T) {
+	cfg := &cfghelper.Config{}
+	cfg.Health.ZeroEventsAnomaly = true
+	tracker := NewHealthTracker()
+	ctx := context.Background()
+	tracker.RecordSuccess(ctx, "Room", 5, cfg)
+	for run := 1; run <= eventCountHistory*2; run++ {
+		tracker.RecordSuccess(ctx, "Room", 0, cfg)
+		if health := tracker.get("Room"); health.UnhealthySince.IsZero() {
+			t.Fatalf("calendar healthy again after %d runs without events", run)
+		}
+	}
+	tracker.RecordSuccess(ctx, "Room", 3, cfg)
+	if health := tracker.get("Room"); !health.UnhealthySince.IsZero() || health.EmptyAfterEvents {
+		t.Error("calendar still unhealthy after returning events again")
+	}
+}
+
+func TestZeroEventsWithoutEarlierEvents(t *testing.T) {
+	cfg := &cfghelper.Config{}
+	cfg.Health.ZeroEventsAnomaly = true
+	tracker := NewHealthTracker()
+	ctx := context.Background()
+	tracker.RecordSuccess(ctx, "Room", 0, cfg)
+	tracker.RecordSuccess(ctx, "Room", 0, cfg)
+	if health := tracker.get("Room"); !health.UnhealthySince.IsZero() {
+		t.Error("calendar that never had events counted as unhealthy")
+	}
+	tracker.RecordFailure(ctx, "Room", errors.New("timeout"))
+	tracker.RecordSuccess(ctx, "Room", 0, cfg)
+	if health := tracker.get("Room"); !health.UnhealthySince.IsZero() {
+		t.Error("calendar not healthy again after a successful fetch")
+	}
+}
+
+func TestCheckAlertsMarksAlerted(t *testing.T) {
+	cfg := &cfghelper.Config{}
+	cfg.Health.AdminEmail.Address = "admin@example.com"
+	tracker := NewHealthTracker()
+	ctx := context.Background()
+	tracker.RecordFailure(ctx, "Room", errors.New("timeout"))
+	// With SendEmails off the alert is only logged, which counts as sent
+	tracker.CheckAlerts(ctx, cfg)
+	if health := tracker.get("Room"); !health.Alerted {
+		t.Error("calendar not marked as alerted")
+	}
+	tracker.RecordSuccess(ctx, "Room", 2, cfg)
+	if health := tracker.get("Room"); health.Alerted || !health.UnhealthySince.IsZero() {
+		t.Error("calendar still alerted after recovering")
+	}
+}
+
+func TestPruneRemovedCalendars(t *testing.T) {
+	tracker := NewHealthTracker()
+	ctx := context.Background()
+	tracker.RecordFailure(ctx, "Room", errors.New("timeout"))
+	tracker.RecordFailure(ctx, "Removed", errors.New("timeout"))
+	tracker.Prune([]string{"Room", "Added"})
+	snapshot := tracker.Snapshot()
+	if len(snapshot) != 1 || snapshot[0].Name != "Room" {
+		t.Errorf("Snapshot() after Prune = %v, want only Room", snapshot)
+	}
+}
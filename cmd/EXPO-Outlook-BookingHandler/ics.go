@@ -1,58 +1,110 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"net/http"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
 	"github.com/apognu/gocal"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-func GetCalendarEventsFromICS(calConfig *cfghelper.CalendarConfig, start, end time.Time) ([]CalendarEvent, error) {
-	resp, err := http.Get(calConfig.URL)
+func GetCalendarEventsFromICS(ctx context.Context, fetcher *ICSFetcher, calConfig *cfghelper.CalendarConfig, start, end time.Time) ([]CalendarEvent, error) {
+	timer := prometheus.NewTimer(icsFetchDuration.WithLabelValues(calConfig.Name))
+	defer timer.ObserveDuration()
+	events, err := getCalendarEvents(ctx, fetcher, calConfig, start, end)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch URL: %w for calendar: %s", err, calConfig.Name)
+		icsErrors.WithLabelValues(calConfig.Name).Inc()
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-	}
-	// Check if the content type is text/calendar, if its text/html the URL is probably wrong or expired
-	if contentType := resp.Header.Get("Content-Type"); contentType != "text/calendar; charset=utf-8" {
-		return nil, fmt.Errorf("unexpected content type: %s", contentType)
-	}
-	calendar := gocal.NewParser(resp.Body)
+	icsEvents.WithLabelValues(calConfig.Name).Set(float64(len(events)))
+	return events, nil
+}
 
-	// Here we can map the timezone IDs from the ICS file to the Go time.Location
-	// This is useful if yourtimezone cant be resolved by Go
-	var tzMapping = map[string]string{
-		"W. Europe Standard Time": "Europe/Stockholm",
+func getCalendarEvents(ctx context.Context, fetcher *ICSFetcher, calConfig *cfghelper.CalendarConfig, start, end time.Time) ([]CalendarEvent, error) {
+	body, err := fetcher.Fetch(ctx, calConfig)
+	if err != nil {
+		return nil, err
 	}
-	gocal.SetTZMapper(func(s string) (*time.Location, error) {
-		if tzid, ok := tzMapping[s]; ok {
-			return time.LoadLocation(tzid)
-		}
-		return nil, fmt.Errorf("unknown timezone: %s", s)
-	})
-	// Set the start and end date for the calendar parser (Which event dates to parse)
-	calendar.Start, calendar.End = &start, &end
-	err = calendar.Parse()
+	parsed, err := parseCalendar(ctx, string(body), start, end)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse calendar: %w", err)
 	}
 	// Convert the gocal events to our own CalendarEvent struct
 	var events []CalendarEvent
-	for _, event := range calendar.Events {
+	for _, event := range parsed {
 		events = append(events, CalendarEvent{
-			Summary:    event.Summary,
-			Start:      *event.Start,
-			End:        *event.End,
-			Reacurring: event.IsRecurring,
-			UID:        event.Uid,
+			Summary:      event.Summary,
+			Start:        *event.Start,
+			End:          *event.End,
+			Reacurring:   event.IsRecurring,
+			UID:          event.Uid,
+			Status:       strings.ToUpper(strings.TrimSpace(event.Status)),
+			Transparency: strings.ToUpper(strings.TrimSpace(event.CustomAttributes[transpAttribute])),
+			BusyStatus:   strings.ToUpper(strings.TrimSpace(event.CustomAttributes["X-MICROSOFT-CDO-BUSYSTATUS"])),
 		})
 
 	}
 	return events, nil
 }
+
+// gocal has a single global TZID mapper, so feeds are parsed one at a time with a mapper for their own VTIMEZONEs
+var parseMutex sync.Mutex
+
+// parseCalendar parses the events of a feed between start and end, resolving its TZIDs with resolveTZID
+func parseCalendar(ctx context.Context, body string, start, end time.Time) ([]gocal.Event, error) {
+	// Timezones without a mapping fall back to the VTIMEZONE definitions in the feed
+	zones := feedTimezones(ctx, body)
+	parseMutex.Lock()
+	defer parseMutex.Unlock()
+	gocal.SetTZMapper(func(tzid string) (*time.Location, error) {
+		return resolveTZID(tzid, zones)
+	})
+	// gocal drops TRANSP since it is not an X- property, rename it so it ends up in CustomAttributes
+	calendar := gocal.NewParser(strings.NewReader(transpReplacer.Replace(body)))
+	// Set the start and end date for the calendar parser (Which event dates to parse)
+	calendar.Start, calendar.End = &start, &end
+	if err := calendar.Parse(); err != nil {
+		return nil, err
+	}
+	return calendar.Events, nil
+}
+
+const transpAttribute = "X-BOOKINGHANDLER-TRANSP"
+
+var transpReplacer = strings.NewReplacer(
+	"\nTRANSP:", "\n"+transpAttribute+":",
+	"\nTRANSP;", "\n"+transpAttribute+";",
+)
+
+// IsCancelled reports if the event has STATUS:CANCELLED
+func (event CalendarEvent) IsCancelled() bool {
+	return event.Status == "CANCELLED"
+}
+
+// CountsAsConflict checks the event STATUS, TRANSP and Outlook busy-status against the configured rules
+func (event CalendarEvent) CountsAsConflict(rules cfghelper.ConflictRules) bool {
+	if event.IsCancelled() {
+		return false
+	}
+	if event.Status != "" && !containsFold(rules.Statuses, event.Status) {
+		return false
+	}
+	if event.Transparency == "TRANSPARENT" && !rules.IncludeTransparent {
+		return false
+	}
+	if event.BusyStatus != "" && !containsFold(rules.BusyStatuses, event.BusyStatus) {
+		return false
+	}
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	return slices.ContainsFunc(values, func(v string) bool {
+		return strings.EqualFold(strings.TrimSpace(v), value)
+	})
+}
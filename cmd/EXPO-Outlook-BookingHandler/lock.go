@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/rs/zerolog/log"
+)
+
+// lockDataDir takes an exclusive lock on the data directory, so two instances sharing it, like overlapping
+// CronJob pods, never check and notify at the same time. It waits for the lock until ctx is done.
+// Without a data directory there is nothing to share, so no lock is taken
+func lockDataDir(ctx context.Context) (func(), error) {
+	file, err := os.OpenFile(lockFile, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		log.Ctx(ctx).Warn().Msgf("Lock: Could not open %s, running without lock: %v", lockFile, err)
+		return func() {}, nil
+	}
+	waiting := false
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return func() {
+				syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+				file.Close()
+			}, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			file.Close()
+			return nil, err
+		}
+		if !waiting {
+			log.Ctx(ctx).Warn().Msg("Lock: Another instance is running a check, waiting for it to finish")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, errors.New("another instance is running a check")
+		case <-time.After(time.Second):
+		}
+	}
+}
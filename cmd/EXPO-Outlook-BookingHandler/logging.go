@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+	"github.com/rs/zerolog"
+	log "github.com/rs/zerolog/log"
+)
+
+// RedactingWriter hides secrets in everything written to the log, so tokens, passwords and calendar URLs
+// never reach the output even when they are part of an error. zerolog has no hook that can change the message,
+// so each JSON line is decoded and the secrets are replaced in the decoded keys and values before it is encoded
+// again. This way a secret with quotes, backslashes or non-ASCII characters is found as it was logged
+type RedactingWriter struct {
+	out      io.Writer
+	mutex    sync.RWMutex
+	pairs    []string
+	replacer *strings.Replacer
+}
+
+var logRedactor = &RedactingWriter{out: os.Stderr, replacer: strings.NewReplacer()}
+
+// Add registers a secret, it is replaced by replacement in all log output. Very short values are ignored
+func (writer *RedactingWriter) Add(secret string, replacement string) {
+	if len(secret) < 4 {
+		return
+	}
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	for i := 0; i < len(writer.pairs); i += 2 {
+		if writer.pairs[i] == secret {
+			return
+		}
+	}
+	writer.pairs = append(writer.pairs, secret, replacement)
+	writer.replacer = strings.NewReplacer(writer.pairs...)
+}
+
+func (writer *RedactingWriter) Write(p []byte) (int, error) {
+	writer.mutex.RLock()
+	replacer, out := writer.replacer, writer.out
+	writer.mutex.RUnlock()
+	redacted, err := redactJSON(p, replacer)
+	if err != nil {
+		// Not a JSON line, like a panic written by a library, redact the text as it is
+		redacted = []byte(replacer.Replace(string(p)))
+	}
+	if _, err := out.Write(redacted); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// setOutput sets where the redacted lines are written
+func (writer *RedactingWriter) setOutput(out io.Writer) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.out = out
+}
+
+// redactJSON decodes a JSON log line token by token, replaces the secrets in every string and encodes it again,
+// keeping the field order
+func redactJSON(line []byte, replacer *strings.Replacer) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	type container struct {
+		object bool
+		count  int // Keys and values written so far
+	}
+	var stack []container
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if delim, ok := token.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			buf.WriteByte(byte(delim))
+			continue
+		}
+		if len(stack) > 0 {
+			parent := &stack[len(stack)-1]
+			if parent.object && parent.count%2 == 1 {
+				buf.WriteByte(':')
+			} else if parent.count > 0 {
+				buf.WriteByte(',')
+			}
+			parent.count++
+		} else if buf.Len() > 0 {
+			return nil, fmt.Errorf("more than one JSON value")
+		}
+		switch value := token.(type) {
+		case json.Delim:
+			stack = append(stack, container{object: value == '{'})
+			buf.WriteByte(byte(value))
+		case string:
+			encoder.Encode(replacer.Replace(value))
+			buf.Truncate(buf.Len() - 1) // Encode adds a newline
+		case json.Number:
+			buf.WriteString(value.String())
+		default:
+			encoder.Encode(value)
+			buf.Truncate(buf.Len() - 1)
+		}
+	}
+	if bytes.HasSuffix(line, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// setupLogging applies the log level and format, all output goes through logRedactor before it is formatted
+func setupLogging(logConfig cfghelper.LogConfig) {
+	applyLogLevel(logConfig.Level)
+	var out io.Writer = os.Stderr
+	if logConfig.Format == "console" {
+		out = zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "2006-01-02 15:04:05", NoColor: true}
+	}
+	logRedactor.setOutput(out)
+	log.Logger = zerolog.New(logRedactor).With().Timestamp().Logger()
+	// log.Ctx falls back to the global logger outside of a run
+	zerolog.DefaultContextLogger = &log.Logger
+}
+
+// applyLogLevel sets the lowest level that is logged, it is safe to call while logging
+func applyLogLevel(name string) {
+	level, err := zerolog.ParseLevel(name)
+	if err != nil {
+		level = zerolog.DebugLevel
+	}
+	zerolog.SetGlobalLevel(level)
+}
+
+// redactSecrets registers the secrets from the config with logRedactor
+func redactSecrets(cfg *cfghelper.Config) {
+	for _, source := range cfg.EXPO.Instances() {
+		logRedactor.Add(source.Token.Value, "[redacted]")
+	}
+	logRedactor.Add(cfg.SMTP.Password.Value, "[redacted]")
+	for _, calendar := range cfg.ICS.Calendars {
+		logRedactor.Add(calendar.URL, redactURL(calendar.URL))
+		logRedactor.Add(calendar.Auth.Password.Value, "[redacted]")
+		logRedactor.Add(calendar.Auth.BearerToken.Value, "[redacted]")
+		for _, header := range calendar.Auth.Headers {
+			logRedactor.Add(header.Value, "[redacted]")
+		}
+	}
+}
+
+type runIDKey struct{}
+
+// withRunID gives a run its own correlation ID, every line logged through log.Ctx(ctx) carries it
+func withRunID(ctx context.Context) context.Context {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+	logger := log.With().Str("run", id).Logger()
+	return logger.WithContext(context.WithValue(ctx, runIDKey{}, id))
+}
+
+func runIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(runIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRedactingWriterEscapedSecrets(t *testing.T) {
+	for _, secret := range []string{`pa"ss\word`, "lösenord-åäö", "tab\tand\nnewline", "<token&more>"} {
+		var out bytes.Buffer
+		redactor := &RedactingWriter{out: &out, replacer: strings.NewReplacer()}
+		redactor.Add(secret, "[redacted]")
+		logger := zerolog.New(redactor)
+		logger.Error().Str("password", secret).Err(errors.New("login with "+secret+" failed")).Msgf("SMTP: %s rejected", secret)
+
+		var fields map[string]any
+		if err := json.Unmarshal(out.Bytes(), &fields); err != nil {
+			t.Fatalf("secret %q: output is not JSON: %v: %s", secret, err, out.String())
+		}
+		for name, value := range fields {
+			if text, ok := value.(string); ok && strings.Contains(text, secret) {
+				t.Errorf("secret %q: field %s = %q still holds the secret", secret, name, text)
+			}
+		}
+		if fields["password"] != "[redacted]" || fields["message"] != "SMTP: [redacted] rejected" || fields["error"] != "login with [redacted] failed" {
+			t.Errorf("secret %q: fields = %v, want every secret replaced", secret, fields)
+		}
+		if !strings.HasSuffix(out.String(), "\n") {
+			t.Errorf("secret %q: output %q does not end with a newline", secret, out.String())
+		}
+	}
+}
+
+func TestRedactingWriterKeepsFieldOrder(t *testing.T) {
+	var out bytes.Buffer
+	redactor := &RedactingWriter{out: &out, replacer: strings.NewReplacer()}
+	redactor.Add("https://calendar.example.com/secret.ics", "https://calendar.example.com/[redacted]")
+	logger := zerolog.New(redactor)
+	logger.Info().Str("run", "abcd").Int("events", 3).Bool("ok", true).Interface("tags", []any{"a", nil, 1.5}).
+		Msg("ICS: Fetched https://calendar.example.com/secret.ics")
+	want := `{"level":"info","run":"abcd","events":3,"ok":true,"tags":["a",null,1.5],"message":"ICS: Fetched https://calendar.example.com/[redacted]"}` + "\n"
+	if out.String() != want {
+		t.Errorf("output = %s, want %s", out.String(), want)
+	}
+}
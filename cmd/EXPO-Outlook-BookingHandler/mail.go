@@ -2,15 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"net"
 	"net/smtp"
 
 	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
@@ -31,6 +35,8 @@ type Overlap struct {
 	icsStartTime    time.Time
 	icsEndTime      time.Time
 	icsName         string
+	expoState       string // State of the booking, like confirmed or preliminary
+	expoSource      string // Name of the EXPO source of the booking, empty with a single unnamed one
 }
 
 type EventData struct {
@@ -40,49 +46,86 @@ type EventData struct {
 }
 
 type CalendarEvent struct {
-	Summary    string
-	Start      time.Time
-	End        time.Time
-	Reacurring bool
-	UID        string
-	TimeZone   string
+	Summary      string
+	Start        time.Time
+	End          time.Time
+	Reacurring   bool
+	UID          string
+	TimeZone     string
+	Status       string // ICS STATUS, e.g. CONFIRMED, TENTATIVE or CANCELLED
+	Transparency string // ICS TRANSP, OPAQUE or TRANSPARENT
+	BusyStatus   string // X-MICROSOFT-CDO-BUSYSTATUS, e.g. BUSY, FREE, TENTATIVE or OOF
 }
 
-func sendEmail(overlap Overlap, mailSettings cfghelper.MailSettings) error {
+// sendEmail notifies the booker of an overlap, returns true if an email was sent or would have been with SendEmails off
+func sendEmail(ctx context.Context, overlap Overlap, mailSettings cfghelper.MailSettings, smtpConfig cfghelper.SMTPConfig) (bool, error) {
 	foundRecipient := true
-	toAddress, err := lookupEmail(overlap.icsSummary, &mailSettings)
+	toAddress, err := lookupEmail(ctx, overlap.icsSummary, &mailSettings)
 	if err != nil {
 		toAddress = mailSettings.FallbackEmail.Address
-		log.Printf("Mail: Error looking up email: %s, sending to fallback: %s", err, toAddress)
+		log.Ctx(ctx).Warn().Msgf("Mail: Error looking up email: %s, sending to fallback: %s", err, toAddress)
 		foundRecipient = false
+		mailLookupMisses.Inc()
 	}
-	const sentEmailsFile = "/app/data/sent_emails.txt"
 	sent, err := hasEmailBeenSent(overlap.icsUID, sentEmailsFile)
 	if err != nil {
-		log.Printf("Mail: Error checking if email has been sent: %v", err)
+		log.Ctx(ctx).Error().Msgf("Mail: Error checking if email has been sent: %v", err)
 	}
 	if sent {
-		log.Printf("Mail: Email for %s already sent, skipping", overlap.icsUID)
-		return nil
+		log.Ctx(ctx).Printf("Mail: Email for %s already sent, skipping", overlap.icsUID)
+		emailsTotal.WithLabelValues("duplicate").Inc()
+		return false, nil
 	}
 	var subject string
 	var htmlContent string
 	if foundRecipient {
 		subject = mailSettings.Subject
-		htmlContent, err = formatContentHTML(mailSettings.MailContent, overlap)
+		content := mailSettings.MailContent
+		if strings.EqualFold(overlap.expoState, "preliminary") && mailSettings.MailContentPreliminary != "" {
+			content = mailSettings.MailContentPreliminary
+			if mailSettings.SubjectPreliminary != "" {
+				subject = mailSettings.SubjectPreliminary
+			}
+		}
+		htmlContent, err = formatContentHTML(content, overlap)
 		if err != nil {
-			log.Printf("Mail: Error formatting fallback content: %v", err)
-			return err
+			log.Ctx(ctx).Error().Msgf("Mail: Error formatting content: %v", err)
+			return false, err
 		}
 	} else {
 		// Use fallback
 		subject = mailSettings.Subject + "-Fallback"
-		htmlContent, err = formatContentHTML(mailSettings.MailContentFallback, overlap)
+		htmlContent, err = formatContentHTML(mailSettings.FallbackContent(), overlap)
 		if err != nil {
-			log.Printf("Mail: Error formatting fallback content: %v", err)
-			return err
+			log.Ctx(ctx).Error().Msgf("Mail: Error formatting fallback content: %v", err)
+			return false, err
+		}
+	}
+	if !mailSettings.SendEmails {
+		// Not marked as sent, so the conflict is still notified once SendEmails is turned on
+		log.Ctx(ctx).Print("Mail: Not sending email, SendEmails is set to false")
+		log.Ctx(ctx).Info().Msgf("Mail: Would have sent email to: %s with subject: %s", toAddress, subject)
+		return true, nil
+	}
+	err = deliverEmail(ctx, smtpConfig, toAddress, subject, htmlContent, mailSettings)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("Mail: Error sending email: %v", err)
+		emailsTotal.WithLabelValues("failed").Inc()
+		return false, err
+	} else {
+		log.Ctx(ctx).Info().Msgf("Mail: Email sent to: %s, from %s", toAddress, mailSettings.From.Address)
+		markEmailAsSent(overlap.icsUID, sentEmailsFile)
+		emailsTotal.WithLabelValues("sent").Inc()
+		if !foundRecipient {
+			emailsFallback.Inc()
 		}
 	}
+
+	return true, nil
+}
+
+// deliverEmail sends an HTML email through the SMTP server, ctx bounds the whole SMTP session
+func deliverEmail(ctx context.Context, smtpConfig cfghelper.SMTPConfig, toAddress string, subject string, htmlContent string, mailSettings cfghelper.MailSettings) error {
 	headers := "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";"
 	message := "From: " + mailSettings.From.Address + "\r\n" +
 		"To: " + toAddress + "\r\n" +
@@ -90,62 +133,120 @@ func sendEmail(overlap Overlap, mailSettings cfghelper.MailSettings) error {
 		headers + "\r\n" +
 		"\r\n" +
 		htmlContent
-	if !mailSettings.SendEmails {
-		log.Print("Mail: Not sending email, SendEmails is set to false")
-		log.Printf("Mail: Would have sent email to: %s with subject: %s", toAddress, subject)
-		markEmailAsSent(overlap.icsUID, sentEmailsFile)
+	log.Ctx(ctx).Printf("Mail: Sending email to: %s from: %s using: %s", toAddress, mailSettings.From.Address, smtpConfig.Host)
+	client, err := dialSMTP(ctx, smtpConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return sendMessage(client, mailSettings.From.Address, toAddress, []byte(message))
+}
+
+// checkSMTP logs in to the SMTP server at startup when emails are sent, so wrong credentials stop the start
+// instead of failing the first email
+func checkSMTP(cfg *cfghelper.Config) error {
+	if !cfg.Email.SendEmails || cfg.DryRun.Enabled {
 		return nil
 	}
-	SMTP_Password := os.Getenv("SMTP_PASSWORD")
-	if SMTP_Password == "" {
-		return errors.New("SMTP Password is not set")
-	}
-	SMTP_USERNAME := os.Getenv("SMTP_USERNAME")
-	if SMTP_USERNAME == "" {
-		return errors.New("SMTP Username is not set")
-	}
-	SMTP_HOST := os.Getenv("SMTP_HOST")
-	if SMTP_HOST == "" {
-		return errors.New("SMTP Host is not set")
-	}
-	SMTP_PORT := os.Getenv("SMTP_PORT") // Default to 587
-	if SMTP_PORT == "" {
-		SMTP_PORT = "587"
-	}
-	auth := smtp.PlainAuth(
-		"",
-		SMTP_USERNAME,
-		SMTP_Password,
-		SMTP_HOST)
-	log.Printf("Mail: Sending email to: %s from: %s using: %s", toAddress, mailSettings.From.Address, SMTP_HOST)
-	err = smtp.SendMail(fmt.Sprintf("%s:%s", SMTP_HOST, SMTP_PORT), auth, mailSettings.From.Address, []string{toAddress}, []byte(message))
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Run.MailTimeout)
+	defer cancel()
+	if err := verifySMTP(ctx, cfg.SMTP); err != nil {
+		return err
+	}
+	log.Info().Msgf("Mail: Logged in to SMTP server %s as %s", cfg.SMTP.Host, cfg.SMTP.Username)
+	return nil
+}
+
+// verifySMTP connects and logs in to the SMTP server without sending anything, so wrong credentials are found at startup
+func verifySMTP(ctx context.Context, smtpConfig cfghelper.SMTPConfig) error {
+	client, err := dialSMTP(ctx, smtpConfig)
 	if err != nil {
-		log.Printf("Mail: Error sending email: %v", err)
 		return err
-	} else {
-		log.Printf("Mail: Email sent to: %s, from %s", toAddress, mailSettings.From.Address)
-		markEmailAsSent(overlap.icsUID, sentEmailsFile)
 	}
+	defer client.Close()
+	return client.Quit()
+}
 
-	return nil
+// dialSMTP connects, starts TLS and logs in, the connection is closed when ctx is done
+func dialSMTP(ctx context.Context, smtpConfig cfghelper.SMTPConfig) (*smtp.Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(smtpConfig.Host, strconv.Itoa(smtpConfig.Port)))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	context.AfterFunc(ctx, func() { conn.Close() })
+	client, err := smtp.NewClient(conn, smtpConfig.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: smtpConfig.Host}); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	if ok, _ := client.Extension("AUTH"); ok {
+		auth := smtp.PlainAuth("", smtpConfig.Username, smtpConfig.Password.Value, smtpConfig.Host)
+		if err = client.Auth(auth); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// sendMessage works like smtp.SendMail on a connected client
+func sendMessage(client *smtp.Client, from string, to string, message []byte) error {
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(message); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
 }
 
-func RegisterOverlap(newOverlap Overlap, mailSettings cfghelper.MailSettings) {
-	log.Printf(("Got new overlap for EXPO Booking %s in Calendar %s with summary: %s"), newOverlap.expoHumanNumber, newOverlap.icsName, newOverlap.icsSummary)
-	err := sendEmail(newOverlap, mailSettings)
+// RegisterOverlap sends the notification for an overlap, returns true if the booker was notified and the error
+// if the notification failed
+func RegisterOverlap(ctx context.Context, newOverlap Overlap, cfg *cfghelper.Config) (bool, error) {
+	log.Ctx(ctx).Info().Msgf("Got new overlap for EXPO Booking %s in Calendar %s with summary: %s", newOverlap.expoHumanNumber, newOverlap.icsName, newOverlap.icsSummary)
+	if cfg.DryRun.Enabled {
+		// The conflict ends up in the dry run report instead
+		return false, nil
+	}
+	// A notification that has started is finished even if the run is cancelled, bounded by its own timeout
+	mailCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.Run.MailTimeout)
+	defer cancel()
+	notified, err := sendEmail(mailCtx, newOverlap, cfg.Email, cfg.SMTP)
 	if err != nil {
-		log.Printf("Error sending email for overlap: %v", err)
+		log.Ctx(ctx).Error().Msgf("Error sending email for overlap: %v", err)
+		return false, fmt.Errorf("booking %s in calendar %s: %w", newOverlap.expoHumanNumber, newOverlap.icsName, err)
 	}
+	return notified, nil
 }
 
-func lookupEmail(icsSummary string, mailSettings *cfghelper.MailSettings) (string, error) {
+func lookupEmail(ctx context.Context, icsSummary string, mailSettings *cfghelper.MailSettings) (string, error) {
 	icsSummary = strings.ToLower(strings.ReplaceAll(icsSummary, " ", ""))
-	log.Print("Mail: Looking up email for summary: ", icsSummary)
+	log.Ctx(ctx).Print("Mail: Looking up email for summary: ", icsSummary)
 	for _, mapping := range mailSettings.Mappings {
 		if strings.ToLower(strings.ReplaceAll(mapping.IcsSummary, " ", "")) == icsSummary {
 			return mapping.Address, nil
 		} else {
-			log.Print("Mail: No match for summary: ", mapping.IcsSummary)
+			log.Ctx(ctx).Print("Mail: No match for summary: ", mapping.IcsSummary)
 		}
 	}
 	return "", fmt.Errorf("no email found for summary: %s", icsSummary)
@@ -174,6 +275,26 @@ func hasEmailBeenSent(icsUID string, filename string) (bool, error) {
 	}
 }
 
+// sentEmailUIDs reads all UIDs in the sent emails file, unlike hasEmailBeenSent it does not create the file
+func sentEmailUIDs(filename string) (map[string]bool, error) {
+	sentEmailsMutex.Lock()
+	defer sentEmailsMutex.Unlock()
+	uids := make(map[string]bool)
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return uids, nil
+		}
+		return uids, err
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			uids[line] = true
+		}
+	}
+	return uids, nil
+}
+
 func markEmailAsSent(icsUID string, filename string) {
 	sentEmailsMutex.Lock()
 	defer sentEmailsMutex.Unlock()
@@ -185,18 +306,65 @@ func markEmailAsSent(icsUID string, filename string) {
 	fmt.Fprintln(file, icsUID)
 }
 
+// CloseConflict removes the UID from the sent emails file, so the conflict is notified again if it reappears.
+// Only call it when no occurrence of the UID still counts as a conflict
+func CloseConflict(ctx context.Context, icsUID string) {
+	removed, err := unmarkEmailAsSent(icsUID, sentEmailsFile)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("Mail: Error closing conflict for %s: %v", icsUID, err)
+		return
+	}
+	if removed {
+		log.Ctx(ctx).Info().Msgf("Mail: Closed conflict for cancelled event %s", icsUID)
+	}
+}
+
+func unmarkEmailAsSent(icsUID string, filename string) (bool, error) {
+	sentEmailsMutex.Lock()
+	defer sentEmailsMutex.Unlock()
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	var kept []string
+	removed := false
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line == "" {
+			continue
+		}
+		if line == icsUID {
+			removed = true
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if !removed {
+		return false, nil
+	}
+	content := strings.Join(kept, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	return true, os.WriteFile(filename, []byte(content), 0644)
+}
+
 func formatContentHTML(contentTemplate string, overlap Overlap) (string, error) {
 	template, err := template.New("email").Parse(contentTemplate)
 	if err != nil {
 		return fmt.Sprintf("Error parsing content template: %v", err), err
 	}
-	data := map[string]interface{}{
-		"Summary":     overlap.icsSummary,
-		"Resource":    overlap.resourceName,
-		"Start":       overlap.icsStartTime.Format(time.RFC3339),
-		"End":         overlap.icsEndTime.Format(time.RFC3339),
-		"BookingURL":  overlap.expoBookingURL,
-		"HumanNumber": overlap.expoHumanNumber,
+	data := cfghelper.TemplateData{
+		Summary:     overlap.icsSummary,
+		Resource:    overlap.resourceName,
+		Start:       overlap.icsStartTime.Format(time.RFC3339),
+		End:         overlap.icsEndTime.Format(time.RFC3339),
+		BookingURL:  overlap.expoBookingURL,
+		HumanNumber: overlap.expoHumanNumber,
+		State:       overlap.expoState,
+		Source:      overlap.expoSource,
 	}
 	var buf bytes.Buffer
 	if err := template.Execute(&buf, data); err != nil {
@@ -1,10 +1,16 @@
 package main
 
 import (
-	"net/url"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
 	"os"
+	"os/signal"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	_ "time/tzdata" // without force loading of timezone data the TZ environment variable is not applied correctly
 
@@ -13,91 +19,258 @@ import (
 )
 
 func main() {
-	// Get app version from version.txt
-	version, err := os.ReadFile("version.txt")
+	// Without a subcommand the handler runs as a daemon, like before the subcommands were added
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	command, ok := findCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+		printUsage()
+		os.Exit(exitFatal)
+	}
+	os.Exit(command.run(args))
+}
+
+//go:embed version.txt
+var versionFile string
+
+// appVersion is version.txt, with the commit it was built from when the build has it
+func appVersion() string {
+	version := strings.TrimSpace(versionFile)
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version
+	}
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if len(revision) > 7 {
+		version += "+" + revision[:7]
+		if modified == "true" {
+			version += "-dirty"
+		}
+	}
+	return version
+}
+
+// setup reads config.yaml and applies the log settings and the TZ env variable
+func setup(configPath string) (*cfghelper.Config, string, error) {
+	// Get settings from config file
+	cfg, err := cfghelper.Load(configPath)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to read version file")
+		return nil, "", fmt.Errorf("failed to get settings: %w", err)
 	}
-	log.Printf("EXPO Outlook BookingHandler version: %s is starting...", version)
+	setupLogging(cfg.Log)
+	redactSecrets(cfg)
+	setDataDir(cfg.Storage.DataDir)
 	// Manually update timezone from TZ env variable
 	if tz := os.Getenv("TZ"); tz != "" {
 		var err error
 		time.Local, err = time.LoadLocation(tz)
 		if err != nil {
-			log.Printf("error loading location '%s': %v\n", tz, err)
+			log.Error().Msgf("error loading location '%s': %v", tz, err)
 		}
 	} else {
-		log.Print("TZ environment variable not found")
+		log.Warn().Msg("TZ environment variable not found")
 	}
-	log.Printf("Timezone set to: %s\n", time.Local)
-	log.Printf("Current time: %s\n", time.Now().Format(time.RFC3339))
+	return cfg, appVersion(), nil
+}
 
-	interval, err := strconv.Atoi(os.Getenv("Interval"))
-	if err != nil {
-		log.Print("Failed to parse Interval environment variable, using default 30 minutes")
-		interval = 1800 // Default interval if not set: 30min
-	} else {
-		log.Print("Interval set to: ", interval, " seconds")
+// runDaemon checks for overlaps on the schedule until SIGTERM or SIGINT
+func runDaemon(args []string) int {
+	flags := newFlagSet("run")
+	configPath := flags.String("config", "config.yaml", "path to config.yaml")
+	if err := flags.Parse(args); err != nil {
+		return exitFatal
 	}
-
-	// Get settings from config file
-	cfg, err := cfghelper.Load("config.yaml")
+	cfg, version, err := setup(*configPath)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to get settings")
+		log.Fatal().Err(err).Msg("Failed to start")
 	}
+	log.Info().Msgf("EXPO Outlook BookingHandler version: %s is starting...", version)
+	log.Info().Msgf("Timezone set to: %s", time.Local)
+	log.Info().Msgf("Current time: %s", time.Now().Format(time.RFC3339))
+
+	log.Info().Msgf("Data directory: %s", dataDir)
 
 	// Setup EXPO
-	expoConfig, err := SetupEXPO()
+	expoConfigs, err := SetupEXPOSources(cfg.EXPO, nil)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to setup EXPO")
 	}
+	if err := checkSMTP(cfg); err != nil {
+		log.Fatal().Err(err).Msg("Failed to log in to the SMTP server")
+	}
+
+	// SIGTERM or SIGINT cancels the running check, the email being sent is finished before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	setupServer(ctx, cfg.Server.Address, version)
+
+	SetupTimezones(cfg.ICS.TimezoneMappings)
+	fetcher := NewICSFetcher(cfg.ICS.Fetch, version)
 
-	checkOverlaps(expoConfig, cfg)
-	setupTicker(interval, expoConfig, cfg)
-	// Keep the application running
-	select {}
+	if err := loadState(ctx, stateFile); err != nil {
+		log.Error().Msgf("State: Error loading %s, starting without it: %v", stateFile, err)
+	}
+	reloader := NewConfigReloader(*configPath, cfg)
+	setupReload(ctx, reloader, cfg.Reload)
+	scheduler := NewScheduler(cfg.Run, func(runCtx context.Context, tier cfghelper.TierConfig) {
+		// A reloaded config is swapped in here, so it changes between runs and never during one
+		runCfg, changed := reloader.ForRun()
+		if changed {
+			fetcher.Configure(runCfg.ICS.Fetch)
+			// The filters are read from the config of every run, only a source with a changed connection needs a new EXPOConfig
+			if newConfigs, err := SetupEXPOSources(runCfg.EXPO, expoConfigs); err != nil {
+				log.Ctx(runCtx).Error().Msgf("Reload: Keeping the old EXPO settings: %v", err)
+			} else {
+				expoConfigs = newConfigs
+			}
+		}
+		lockedCheck(runCtx, runCtx, tier, expoConfigs, fetcher, runCfg, false)
+	})
+	schedule := NewSchedule(cfg.Schedule)
+	scheduler.Trigger(ctx, fullTier)
+	setupSchedule(ctx, schedule, scheduler)
+	setupTiers(ctx, cfg.Schedule.Tiers, schedule, scheduler)
+	// Keep the application running until we get a signal
+	<-ctx.Done()
+	log.Info().Msg("Shutting down, waiting for the current run to finish...")
+	scheduler.Wait()
+	log.Info().Msg("Shutdown complete")
+	return exitOK
 }
 
-func checkOverlaps(expoConfig *EXPOConfig, cfg *cfghelper.Config) {
-	// Get today -1 day and the last day of the month
-	start, end := GetMonthDateRange()
+// lockedCheck runs checkOverlaps while holding the data directory lock, waiting for it until lockCtx is done,
+// and saves the state afterwards so the next run or instance continues from it. With load set the saved
+// state is loaded first, for a single run like a CronJob
+func lockedCheck(ctx context.Context, lockCtx context.Context, tier cfghelper.TierConfig, expoConfigs []*EXPOConfig, fetcher *ICSFetcher, cfg *cfghelper.Config, load bool) (RunStatus, error) {
+	unlock, err := lockDataDir(lockCtx)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("Skipping the %s run: %v", tier.Name, err)
+		return RunStatus{}, err
+	}
+	defer unlock()
+	if load {
+		if err := loadState(ctx, stateFile); err != nil {
+			log.Ctx(ctx).Error().Msgf("State: Error loading %s, starting without it: %v", stateFile, err)
+		}
+	}
+	status := checkOverlaps(ctx, windowForTier(ctx, tier), expoConfigs, fetcher, cfg)
+	if err := saveState(stateFile); err != nil {
+		log.Ctx(ctx).Warn().Msgf("State: Error saving %s: %v", stateFile, err)
+	}
+	return status, nil
+}
+
+// checkOverlaps runs one check of the window and returns its result, which is also recorded for /status
+func checkOverlaps(ctx context.Context, window CheckWindow, expoConfigs []*EXPOConfig, fetcher *ICSFetcher, cfg *cfghelper.Config) (status RunStatus) {
+	start, end := window.Start, window.End
+	log.Ctx(ctx).Info().Msgf("Checking %s window from %s to %s", window.Name, start.Format(time.RFC3339), end.Format(time.RFC3339))
+	// The result of the run is shown by /status
+	status = RunStatus{ID: runIDFrom(ctx), Window: window.Name, WindowStart: start, WindowEnd: end, StartedAt: time.Now()}
+	defer func() {
+		status.Duration = time.Since(status.StartedAt).Round(time.Millisecond).String()
+		if status.Error == "" && ctx.Err() != nil {
+			status.Error = ctx.Err().Error()
+		}
+		status.Success = status.Error == ""
+		runStatus.Record(status)
+		if status.Success {
+			runsTotal.WithLabelValues(window.Name, "success").Inc()
+			lastSuccessfulRun.WithLabelValues(window.Name).SetToCurrentTime()
+		} else {
+			runsTotal.WithLabelValues(window.Name, "failure").Inc()
+		}
+	}()
 	var monitoredResources []string
+	var calendarNames []string
 	for _, cal := range cfg.ICS.Calendars {
 		monitoredResources = append(monitoredResources, cal.EXPOResourceName)
+		calendarNames = append(calendarNames, cal.Name)
 	}
-	// Fetch bookings from EXPO
-	expoBookings := GetNewBookings(expoConfig, start, end)
-	expoBookings = filterConfirmedBookings(expoBookings)
-	expoBookings = filterBookingWithResource(expoBookings, monitoredResources)
-	bookingsURLSuffix := "/administration/bookings/"
-	_, err := url.Parse(expoConfig.EXPOURL + bookingsURLSuffix)
-	if err != nil {
-		log.Print("Error parsing EXPO URL: ", err)
+	// Fetch bookings from every EXPO source, a source that fails only skips the calendars of its resources
+	bookingsBySource := make(map[string][]QueryUserResponseBookingNode)
+	expoURLs := make(map[string]string)
+	complete := make(map[string]bool)
+	for _, expoConfig := range expoConfigs {
+		bookings, sourceStatus := fetchSourceBookings(sourceContext(ctx, expoConfig.Name), window, expoConfig, cfg)
+		status.EXPOSources = append(status.EXPOSources, sourceStatus)
+		bookingsBySource[expoConfig.Name] = bookings
+		expoURLs[expoConfig.Name] = expoConfig.EXPOURL
+		complete[expoConfig.Name] = sourceStatus.Success && !sourceStatus.Incomplete
+	}
+	status.EXPO = combineEXPOStatus(status.EXPOSources)
+	if len(status.EXPOSources) == 1 {
+		status.EXPOSources = nil
+	}
+	if !status.EXPO.Success {
+		log.Ctx(ctx).Error().Msg("Failed to fetch EXPO bookings, skipping this run")
+		status.Error = "failed to fetch EXPO bookings"
 		return
 	}
-	// Loop through the calendars and get the events
+	bookingsURLSuffix := "/administration/bookings/"
+	// Fetch all calendars in parallel, then loop through them in config order so logs and notifications stay stable
+	log.Ctx(ctx).Print("Fetching ", len(cfg.ICS.Calendars), " calendars using ", cfg.ICS.Fetch.Workers, " workers")
+	results := fetcher.FetchCalendars(ctx, cfg.ICS.Calendars, cfg.ICS.Fetch.Workers, start, end)
+	var found []Overlap
+	failedCalendars := make(map[string]bool)
+	calendarHealth.Prune(calendarNames)
 	for i, ics := range cfg.ICS.Calendars {
-		log.Print("Fetching calendar: ", ics.Name)
-		events, err := GetCalendarEventsFromICS(&cfg.ICS.Calendars[i], start, end)
-		if err != nil {
-			log.Print("ICS: Error getting calendar events: ", err)
+		if err := results[i].err; err != nil {
+			log.Ctx(ctx).Error().Msgf("ICS: Error getting calendar events: %v", err)
+			calendarHealth.RecordFailure(ctx, ics.Name, err)
+			failedCalendars[ics.Name] = true
+		} else if window.Full {
+			calendarHealth.RecordSuccess(ctx, ics.Name, len(results[i].events), cfg)
+		} else {
+			// Event counts of a narrowed window are not comparable with the full window
+			calendarHealth.RecordSuccess(ctx, ics.Name, -1, cfg)
+		}
+	}
+	status.Calendars = calendarStatuses(calendarNames, results)
+	if !cfg.DryRun.Enabled {
+		for _, uid := range cancelledUIDs(window, results, cfg.ICS.ConflictRules) {
+			CloseConflict(ctx, uid)
 		}
-		log.Print("ICS: Found ", len(events), " events in calendar: ", ics.Name)
+	}
+	for i, ics := range cfg.ICS.Calendars {
+		events := results[i].events
+		log.Ctx(ctx).Print("ICS: Found ", len(events), " events in calendar: ", ics.Name)
 		// Loop through the events and check for overlaps
 		for _, event := range events {
-			//log.Print("ICS: Event: ", event.Summary, " Start: ", event.Start.Format(time.RFC3339), " End: ", event.End.Format(time.RFC3339))
+			//log.Ctx(ctx).Print("ICS: Event: ", event.Summary, " Start: ", event.Start.Format(time.RFC3339), " End: ", event.End.Format(time.RFC3339))
 			if event.Reacurring {
-				log.Print("ICS: Event is recurring")
+				log.Ctx(ctx).Print("ICS: Event is recurring")
+			}
+			if event.IsCancelled() {
+				continue
+			}
+			if !event.CountsAsConflict(cfg.ICS.ConflictRules) {
+				log.Ctx(ctx).Printf("ICS: Skipping event %s, status: %s, transp: %s, busy-status: %s", event.UID, event.Status, event.Transparency, event.BusyStatus)
+				continue
 			}
 			// Loop through all bookings and check for overlaps with the current event
-			for _, booking := range expoBookings {
+			for _, booking := range bookingsBySource[ics.EXPOSource] {
 				for _, monitoredResource := range monitoredResources {
 					if strings.EqualFold(ics.Name, monitoredResource) {
-						//log.Printf("Event %s in calendar %s matches resourceMap %s", event.Summary, ics.Name, resourceMap.EXPOResourceName)
-						doesOverlap, overlapEventName, eventStartTime, eventEndTime := doesBookingResourceOverlap(booking, event.Start, event.End, ics.Name)
+						//log.Ctx(ctx).Printf("Event %s in calendar %s matches resourceMap %s", event.Summary, ics.Name, resourceMap.EXPOResourceName)
+						doesOverlap, overlapEventName, eventStartTime, eventEndTime := doesBookingResourceOverlap(ctx, booking, event.Start, event.End, ics.Name)
 						if doesOverlap {
-							bookingURL := expoConfig.EXPOURL + bookingsURLSuffix + strconv.Itoa(booking.ID)
-							RegisterOverlap(Overlap{
+							if ctx.Err() != nil {
+								log.Ctx(ctx).Warn().Msgf("Run cancelled, skipping the remaining notifications: %v", ctx.Err())
+								return
+							}
+							bookingURL := expoURLs[ics.EXPOSource] + bookingsURLSuffix + strconv.Itoa(booking.ID)
+							overlap := Overlap{
 								monitoredResource,
 								bookingURL,
 								booking.HumanNumber,
@@ -109,8 +282,18 @@ func checkOverlaps(expoConfig *EXPOConfig, cfg *cfghelper.Config) {
 								event.Start,
 								event.End,
 								ics.Name,
-							}, cfg.Email,
-							)
+								booking.State,
+								ics.EXPOSource,
+							}
+							found = append(found, overlap)
+							overlapsDetected.WithLabelValues(monitoredResource).Inc()
+							status.ConflictsFound++
+							notified, err := RegisterOverlap(ctx, overlap, cfg)
+							if err != nil {
+								status.NotifyErrors = append(status.NotifyErrors, err.Error())
+							} else if notified {
+								status.ConflictsNotified++
+							}
 							break
 						}
 					}
@@ -119,30 +302,124 @@ func checkOverlaps(expoConfig *EXPOConfig, cfg *cfghelper.Config) {
 
 		}
 	}
+	for _, ics := range cfg.ICS.Calendars {
+		if !complete[ics.EXPOSource] {
+			// A conflict of a booking that was not fetched is not resolved, like the conflicts of a failed calendar
+			failedCalendars[ics.Name] = true
+		}
+	}
+	added, resolved := conflictState.Update(ctx, window, found, failedCalendars)
+	log.Ctx(ctx).Info().Msgf("Conflicts: %d found in %s window, %d new, %d resolved, %d open", len(found), window.Name, added, resolved, conflictState.Count())
+	calendarHealth.CheckAlerts(ctx, cfg)
+	if cfg.DryRun.Enabled {
+		if err := saveConflictReport(ctx, cfg); err != nil {
+			log.Ctx(ctx).Error().Msgf("Report: Error writing dry run report: %v", err)
+		}
+	}
+	return
+}
+
+// cancelledUIDs returns the UIDs of the cancelled events whose conflicts can be closed. A cancelled occurrence of a
+// recurring series shares the UID of the occurrences that still take place, so a UID is only returned when none of
+// its occurrences counts as a conflict. A narrowed window does not see the later occurrences, so only the full window
+// closes conflicts
+func cancelledUIDs(window CheckWindow, results []calendarResult, rules cfghelper.ConflictRules) []string {
+	if !window.Full {
+		return nil
+	}
+	live := make(map[string]bool)
+	for _, result := range results {
+		for _, event := range result.events {
+			if event.CountsAsConflict(rules) {
+				live[event.UID] = true
+			}
+		}
+	}
+	var uids []string
+	seen := make(map[string]bool)
+	for _, result := range results {
+		for _, event := range result.events {
+			if event.IsCancelled() && !live[event.UID] && !seen[event.UID] {
+				seen[event.UID] = true
+				uids = append(uids, event.UID)
+			}
+		}
+	}
+	return uids
+}
+
+// fetchSourceBookings fetches the bookings of one EXPO source and filters them with its filters and the resources of
+// its calendars. An incomplete fetch returns the bookings fetched so far, marked as incomplete in the status
+func fetchSourceBookings(ctx context.Context, window CheckWindow, expoConfig *EXPOConfig, cfg *cfghelper.Config) ([]QueryUserResponseBookingNode, EXPOStatus) {
+	status := EXPOStatus{Name: expoConfig.Name}
+	settings, err := sourceSettings(cfg, expoConfig.Name)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("Skipping EXPO source: %v", err)
+		status.Error = err.Error()
+		return nil, status
+	}
+	bookings, err := GetNewBookings(ctx, expoConfig, window.Start, window.End, window.Full)
+	incomplete := errors.Is(err, errIncompleteFetch)
+	if err != nil && !incomplete {
+		log.Ctx(ctx).Error().Msgf("Failed to fetch EXPO bookings: %v", err)
+		status.Error = err.Error()
+		return nil, status
+	}
+	var monitoredResources []string
+	for _, calendar := range cfg.ICS.Calendars {
+		if calendar.EXPOSource == expoConfig.Name {
+			monitoredResources = append(monitoredResources, calendar.EXPOResourceName)
+		}
+	}
+	bookings = filterBookings(ctx, bookings, settings.Filters, monitoredResources)
+	status.Success, status.Bookings = true, len(bookings)
+	if incomplete {
+		// The fetched bookings are still checked, but the run counts as a partial failure
+		log.Ctx(ctx).Error().Msgf("EXPO bookings are incomplete, checking the %d fetched: %v", len(bookings), err)
+		status.Incomplete = true
+		status.Error = err.Error()
+	}
+	return bookings, status
 }
 
-func GetMonthDateRange() (time.Time, time.Time) {
+// sourceSettings returns the settings of the EXPO source with the name from cfg, an error when it is not there, like
+// when a reload removed it
+func sourceSettings(cfg *cfghelper.Config, name string) (cfghelper.EXPOSettings, error) {
+	for _, source := range cfg.EXPO.Instances() {
+		if source.Name == name {
+			return source, nil
+		}
+	}
+	return cfghelper.EXPOSettings{}, fmt.Errorf("EXPO source %q is not in the config", name)
+}
+
+// sourceContext adds the name of the source to the log lines of ctx, a single unnamed source has none
+func sourceContext(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return log.Ctx(ctx).With().Str("source", name).Logger().WithContext(ctx)
+}
+
+// windowForTier returns the window a run of the tier checks, the full tier uses GetMonthDateRange
+func windowForTier(ctx context.Context, tier cfghelper.TierConfig) CheckWindow {
+	if tier.Horizon == 0 {
+		// Get today -1 day and the last day of the month
+		start, end := GetMonthDateRange(ctx)
+		return CheckWindow{Name: tier.Name, Start: start, End: end, Full: true}
+	}
+	now := time.Now()
+	return CheckWindow{Name: tier.Name, Start: now, End: now.Add(tier.Horizon)}
+}
+
+func GetMonthDateRange(ctx context.Context) (time.Time, time.Time) {
 	// Calculate the first and last day of the current month
 	now := time.Now()
 	firstDay := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
 	lastDay := firstDay.AddDate(0, 1, -1).Add(23*time.Hour + 59*time.Minute + 59*time.Second)
 	start := now.Add(-1 * time.Hour * 24)
 	end := lastDay
-	log.Print("Start date: ", start)
-	log.Print("End date: ", end)
+	log.Ctx(ctx).Print("Start date: ", start)
+	log.Ctx(ctx).Print("End date: ", end)
 	return start, end
 }
-
-func setupTicker(interval int, expoConfig *EXPOConfig, settings *cfghelper.Config) {
-	log.Print("Setting up ticker with interval ", interval, " seconds")
-	ticker := time.NewTicker(time.Duration(interval) * time.Second)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				log.Print(("Ticker triggered, checking overlaps..."))
-				checkOverlaps(expoConfig, settings)
-			}
-		}
-	}()
-}
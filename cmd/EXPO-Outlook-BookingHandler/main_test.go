@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+)
+
+func TestCancelledUIDs(t *testing.T) {
+	rules := cfghelper.ConflictRules{Statuses: []string{"CONFIRMED", "TENTATIVE"}, BusyStatuses: []string{"BUSY", "OOF"}}
+	start := time.Date(2026, 11, 2, 9, 0, 0, 0, time.UTC)
+	occurrence := func(uid string, week int, status string) CalendarEvent {
+		at := start.AddDate(0, 0, 7*week)
+		return CalendarEvent{UID: uid, Start: at, End: at.Add(time.Hour), Reacurring: true, Status: status}
+	}
+	// The first occurrence of the series is cancelled, the one a week later still takes place
+	near := []calendarResult{{events: []CalendarEvent{occurrence("series", 0, "CANCELLED"), occurrence("single", 0, "CANCELLED")}}}
+	full := []calendarResult{{events: append(slices.Clone(near[0].events), occurrence("series", 1, "CONFIRMED"))}}
+
+	if got := cancelledUIDs(CheckWindow{Name: "near", Full: false}, near, rules); got != nil {
+		t.Errorf("narrowed window: cancelledUIDs() = %v, want none, it does not see the later occurrences", got)
+	}
+	if got, want := cancelledUIDs(CheckWindow{Name: "full", Full: true}, full, rules), []string{"single"}; !slices.Equal(got, want) {
+		t.Errorf("full window: cancelledUIDs() = %v, want %v", got, want)
+	}
+	// Once every occurrence is cancelled the series is closed too
+	full[0].events[2].Status = "CANCELLED"
+	if got, want := cancelledUIDs(CheckWindow{Name: "full", Full: true}, full, rules), []string{"series", "single"}; !slices.Equal(got, want) {
+		t.Errorf("full window, series cancelled: cancelledUIDs() = %v, want %v", got, want)
+	}
+}
+
+func TestFetchSourceBookingsPerSource(t *testing.T) {
+	now := time.Now().Truncate(time.Hour)
+	// Both sources return a confirmed and a preliminary booking of their Hall
+	hallBooking := func(id int, state string) QueryUserResponseBookingNode {
+		booking := testBooking(id, now.Add(time.Hour), now.Add(2*time.Hour))
+		booking.State = state
+		nodes := &booking.Reservations.Nodes[0].Reservationable.Event.EventAllocation.EventAllocationResources.Nodes
+		*nodes = append(*nodes, struct{ Resource EXPOResource }{EXPOResource{Name: "Hall"}})
+		return booking
+	}
+	respond := func(page int, variables map[string]any) QueryUserResponse {
+		return onePage(hallBooking(1, "confirmed"), hallBooking(2, "preliminary"))
+	}
+	north, south := newFakeEXPO(t, respond), newFakeEXPO(t, respond)
+	cfg := &cfghelper.Config{
+		EXPO: cfghelper.EXPOSettings{Sources: []cfghelper.EXPOSettings{
+			{Name: "north", Filters: cfghelper.BookingFilters{States: []string{"confirmed"}}},
+			{Name: "south", Filters: cfghelper.BookingFilters{States: []string{"confirmed", "preliminary"}}},
+		}},
+		ICS: cfghelper.ICSConfig{Calendars: []cfghelper.CalendarConfig{
+			{Name: "North hall", EXPOResourceName: "Hall", EXPOSource: "north"},
+			{Name: "South hall", EXPOResourceName: "Hall", EXPOSource: "south"},
+		}},
+	}
+	window := CheckWindow{Name: "full", Start: now, End: now.Add(48 * time.Hour), Full: true}
+	tests := []struct {
+		fake    *fakeEXPO
+		name    string
+		wantIDs []int
+	}{
+		{north, "north", []int{1}},
+		{south, "south", []int{1, 2}},
+	}
+	for _, test := range tests {
+		expoConfig := test.fake.config(cfghelper.PaginationConfig{MaxPages: 100})
+		expoConfig.Name = test.name
+		bookings, status := fetchSourceBookings(context.Background(), window, expoConfig, cfg)
+		if !status.Success || !slices.Equal(bookingIDs(bookings), test.wantIDs) {
+			t.Errorf("%s: fetchSourceBookings() = %v, %+v, want bookings %v with the filters of the source", test.name, bookingIDs(bookings), status, test.wantIDs)
+		}
+	}
+
+	// A source removed from the config, like by a reload during the run, is skipped instead of using another one
+	cfg.EXPO.Sources = cfg.EXPO.Sources[:1]
+	expoConfig := south.config(cfghelper.PaginationConfig{MaxPages: 100})
+	expoConfig.Name = "south"
+	requests := len(south.requests())
+	bookings, status := fetchSourceBookings(context.Background(), window, expoConfig, cfg)
+	if bookings != nil || status.Success || !strings.Contains(status.Error, `"south" is not in the config`) {
+		t.Errorf("removed source: fetchSourceBookings() = %v, %+v, want an error", bookingIDs(bookings), status)
+	}
+	if len(south.requests()) != requests {
+		t.Error("removed source: fetchSourceBookings() still fetched its bookings")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics served on /metrics
+var (
+	expoFetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bookinghandler_expo_fetch_duration_seconds",
+		Help:    "Duration of fetching all booking pages from EXPO.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+	expoFetchPages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bookinghandler_expo_fetch_pages_total",
+		Help: "Number of booking pages fetched from EXPO.",
+	})
+	expoSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookinghandler_expo_syncs_total",
+		Help: "Number of EXPO syncs by mode: full or incremental.",
+	}, []string{"mode"})
+	expoErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookinghandler_expo_errors_total",
+		Help: "Number of failed EXPO fetches by error type.",
+	}, []string{"type"})
+	icsFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bookinghandler_ics_fetch_duration_seconds",
+		Help:    "Duration of fetching and parsing a calendar.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"calendar"})
+	icsErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookinghandler_ics_errors_total",
+		Help: "Number of failed calendar fetches.",
+	}, []string{"calendar"})
+	icsEvents = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bookinghandler_ics_events",
+		Help: "Number of events in the last fetch of a calendar.",
+	}, []string{"calendar"})
+	overlapsDetected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookinghandler_overlaps_detected_total",
+		Help: "Number of overlaps detected, counted every run they are found.",
+	}, []string{"resource"})
+	emailsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookinghandler_emails_total",
+		Help: "Number of conflict emails by result: sent, duplicate or failed.",
+	}, []string{"result"})
+	emailsFallback = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bookinghandler_emails_fallback_total",
+		Help: "Number of conflict emails sent to the fallback address.",
+	})
+	mailLookupMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bookinghandler_mail_lookup_misses_total",
+		Help: "Number of ICS summaries without an email mapping.",
+	})
+	runsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookinghandler_runs_total",
+		Help: "Number of check runs by window and result.",
+	}, []string{"window", "result"})
+	lastSuccessfulRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bookinghandler_last_successful_run_timestamp_seconds",
+		Help: "Unix time of the last successful run, alert if this gets old.",
+	}, []string{"window"})
+)
+
+// expoErrorType groups EXPO errors for the expo errors metric
+func expoErrorType(err error) string {
+	message := strings.ToLower(err.Error())
+	switch {
+	case errors.Is(err, errIncompleteFetch):
+		return "incomplete"
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled):
+		return "timeout"
+	case strings.Contains(message, "401") || strings.Contains(message, "403") || strings.Contains(message, "unauthorized"):
+		return "unauthorized"
+	case strings.HasPrefix(message, "graphql:"):
+		return "graphql"
+	case strings.Contains(message, "decoding response"):
+		return "decode"
+	default:
+		return "network"
+	}
+}
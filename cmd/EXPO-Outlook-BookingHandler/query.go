@@ -0,0 +1,166 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+)
+
+// defaultQuery is the booking query compiled into the binary, EXPO.QueryFile replaces it
+//
+//go:embed query-booking.graphql
+var defaultQuery string
+
+// defaultUpdatedQuery fetches the bookings updated since the last sync, EXPO.Sync.QueryFile replaces it
+//
+//go:embed query-booking-updated.graphql
+var defaultUpdatedQuery string
+
+// The variables fetchBookingWindow and fetchUpdatedBookings set, a query has to declare them. $first is only
+// needed when EXPO.Pagination.PageSize is set
+var (
+	windowQueryVariables  = []string{"startAtGteq", "endAtLteq", "cursor"}
+	updatedQueryVariables = []string{"updatedAtGteq", "cursor"}
+)
+
+// queryVariables adds $first to the variables a query has to declare when the page size is set
+func queryVariables(variables []string, pagination cfghelper.PaginationConfig) []string {
+	if pagination.PageSize > 0 {
+		return append(slices.Clone(variables), "first")
+	}
+	return variables
+}
+
+// loadQuery returns the embedded query, or the one in path checked against the variables and the fields
+// QueryUserResponse needs
+func loadQuery(path string, embedded string, variables []string) (string, error) {
+	if path == "" {
+		return embedded, nil
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read query file: %w", err)
+	}
+	query := string(buf)
+	if err := checkQuery(query, variables); err != nil {
+		return "", fmt.Errorf("query file %s: %w", path, err)
+	}
+	return query, nil
+}
+
+// checkQuery reports the variables and fields that are missing from a query, so a wrong override query fails
+// at startup instead of silently decoding to empty bookings
+func checkQuery(query string, variables []string) error {
+	document, err := parser.ParseQuery(&ast.Source{Input: query})
+	if err != nil {
+		return err
+	}
+	if len(document.Operations) != 1 {
+		return fmt.Errorf("expected one operation, found %d", len(document.Operations))
+	}
+	operation := document.Operations[0]
+	selection := &selectionNode{fields: make(map[string]*selectionNode)}
+	if err := selection.add(operation.SelectionSet, document.Fragments, nil); err != nil {
+		return err
+	}
+	var missing []string
+	for _, variable := range variables {
+		if operation.VariableDefinitions.ForName(variable) == nil {
+			missing = append(missing, "$"+variable)
+		}
+	}
+	missing = append(missing, missingFields(reflect.TypeOf(QueryUserResponse{}), selection, "")...)
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// missingFields lists the fields of typ that are not selected, named like bookings.nodes.humanNumber
+func missingFields(typ reflect.Type, selection *selectionNode, path string) []string {
+	for typ.Kind() == reflect.Pointer || typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct || typ == reflect.TypeOf(time.Time{}) {
+		return nil
+	}
+	var missing []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		// The response is decoded with encoding/json, which matches the names without case
+		name := string(unicode.ToLower(rune(field.Name[0]))) + field.Name[1:]
+		if field.Name == "ID" {
+			name = "id"
+		}
+		if tag, _, _ := strings.Cut(field.Tag.Get("json"), ","); tag != "" {
+			name = tag
+		}
+		child := selection.find(name)
+		if child == nil {
+			// Fields of the other reservation types are only needed when the query selects them
+			if field.Tag.Get("query") != "optional" {
+				missing = append(missing, path+name)
+			}
+			continue
+		}
+		missing = append(missing, missingFields(field.Type, child, path+name+".")...)
+	}
+	return missing
+}
+
+// selectionNode is a field of a query with the fields selected below it
+type selectionNode struct {
+	fields map[string]*selectionNode
+}
+
+func (node *selectionNode) find(name string) *selectionNode {
+	for key, child := range node.fields {
+		if strings.EqualFold(key, name) {
+			return child
+		}
+	}
+	return nil
+}
+
+// add merges the fields of set into node. Aliases are used as the field name like in the response, and the
+// fields of fragments are merged into the field they are in. spreads are the named fragments being expanded
+func (node *selectionNode) add(set ast.SelectionSet, fragments ast.FragmentDefinitionList, spreads []string) error {
+	for _, selection := range set {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			child := node.fields[selection.Alias]
+			if child == nil {
+				child = &selectionNode{fields: make(map[string]*selectionNode)}
+				node.fields[selection.Alias] = child
+			}
+			if err := child.add(selection.SelectionSet, fragments, spreads); err != nil {
+				return err
+			}
+		case *ast.InlineFragment:
+			if err := node.add(selection.SelectionSet, fragments, spreads); err != nil {
+				return err
+			}
+		case *ast.FragmentSpread:
+			fragment := fragments.ForName(selection.Name)
+			if fragment == nil {
+				return fmt.Errorf("fragment %s is not defined", selection.Name)
+			}
+			if slices.Contains(spreads, selection.Name) {
+				return fmt.Errorf("fragment %s spreads itself", selection.Name)
+			}
+			if err := node.add(fragment.SelectionSet, fragments, append(spreads, selection.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+)
+
+func TestEmbeddedQueries(t *testing.T) {
+	for _, pagination := range []cfghelper.PaginationConfig{{}, {PageSize: 50}} {
+		if err := checkQuery(defaultQuery, queryVariables(windowQueryVariables, pagination)); err != nil {
+			t.Errorf("booking query, page size %d: %v", pagination.PageSize, err)
+		}
+		if err := checkQuery(defaultUpdatedQuery, queryVariables(updatedQueryVariables, pagination)); err != nil {
+			t.Errorf("updated booking query, page size %d: %v", pagination.PageSize, err)
+		}
+	}
+}
+
+func TestExampleQueries(t *testing.T) {
+	for _, example := range []struct {
+		path      string
+		variables []string
+	}{
+		{"../../Examples/query-booking-all-reservations.graphql", windowQueryVariables},
+		{"../../Examples/query-booking-updated-all-reservations.graphql", updatedQueryVariables},
+	} {
+		variables := queryVariables(example.variables, cfghelper.PaginationConfig{PageSize: 50})
+		if _, err := loadQuery(example.path, "", variables); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCheckQueryMissingField(t *testing.T) {
+	query := strings.Replace(defaultQuery, "humanNumber\n", "\n", 1)
+	err := checkQuery(query, windowQueryVariables)
+	if err == nil || !strings.Contains(err.Error(), "bookings.nodes.humanNumber") {
+		t.Errorf("checkQuery() = %v, want missing bookings.nodes.humanNumber", err)
+	}
+}
+
+func TestCheckQueryAlias(t *testing.T) {
+	// The response uses the alias, so an alias with the expected name selects the field
+	query := strings.Replace(defaultQuery, "humanNumber\n", "humanNumber: number\n", 1)
+	if err := checkQuery(query, windowQueryVariables); err != nil {
+		t.Errorf("checkQuery() with alias humanNumber: %v", err)
+	}
+	query = strings.Replace(defaultQuery, "humanNumber\n", "number: humanNumber\n", 1)
+	err := checkQuery(query, windowQueryVariables)
+	if err == nil || !strings.Contains(err.Error(), "bookings.nodes.humanNumber") {
+		t.Errorf("checkQuery() with humanNumber aliased away = %v, want missing bookings.nodes.humanNumber", err)
+	}
+}
+
+func TestCheckQueryNamedFragment(t *testing.T) {
+	query := strings.Replace(defaultQuery, "      humanNumber\n", "      ...BookingFields\n", 1)
+	if err := checkQuery(query+"\nfragment BookingFields on Booking {\n  humanNumber\n}\n", windowQueryVariables); err != nil {
+		t.Errorf("checkQuery() with named fragment: %v", err)
+	}
+	err := checkQuery(query, windowQueryVariables)
+	if err == nil || !strings.Contains(err.Error(), "fragment BookingFields is not defined") {
+		t.Errorf("checkQuery() without the fragment = %v, want undefined fragment error", err)
+	}
+	err = checkQuery(query+"\nfragment BookingFields on Booking {\n  ...BookingFields\n}\n", windowQueryVariables)
+	if err == nil || !strings.Contains(err.Error(), "spreads itself") {
+		t.Errorf("checkQuery() with a fragment cycle = %v, want cycle error", err)
+	}
+}
+
+func TestCheckQuerySyntaxError(t *testing.T) {
+	query := strings.Replace(defaultQuery, "humanNumber\n", "humanNumber(\n", 1)
+	if err := checkQuery(query, windowQueryVariables); err == nil {
+		t.Error("checkQuery() with an unclosed argument list returned no error")
+	}
+}
+
+func TestCheckQueryFirstVariable(t *testing.T) {
+	query := strings.Replace(defaultQuery, ", $first: Int", "", 1)
+	query = strings.Replace(query, "first: $first\n", "\n", 1)
+	if err := checkQuery(query, queryVariables(windowQueryVariables, cfghelper.PaginationConfig{})); err != nil {
+		t.Errorf("checkQuery() without page size: %v", err)
+	}
+	err := checkQuery(query, queryVariables(windowQueryVariables, cfghelper.PaginationConfig{PageSize: 50}))
+	if err == nil || !strings.Contains(err.Error(), "$first") {
+		t.Errorf("checkQuery() with page size = %v, want missing $first", err)
+	}
+}
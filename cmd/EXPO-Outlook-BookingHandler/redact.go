@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+)
+
+// redactURL keeps the scheme and host of a URL and hides the rest, published calendar links carry their secret in the path
+func redactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return "[redacted URL]"
+	}
+	return parsed.Scheme + "://" + parsed.Host + "/[redacted]"
+}
+
+// redactURLError replaces the URL in errors from the http client, since they print the full URL
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		redacted := *urlErr
+		redacted.URL = redactURL(urlErr.URL)
+		return &redacted
+	}
+	return err
+}
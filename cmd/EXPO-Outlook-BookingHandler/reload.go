@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+	log "github.com/rs/zerolog/log"
+)
+
+// ConfigReloader reloads config.yaml when it changes or on SIGHUP. A valid new config is used from the next run,
+// so a run never sees two configs, an invalid one is logged and the current config stays active
+type ConfigReloader struct {
+	path    string
+	mutex   sync.Mutex
+	current *cfghelper.Config
+	pending *cfghelper.Config
+	hash    [sha256.Size]byte
+}
+
+func NewConfigReloader(path string, cfg *cfghelper.Config) *ConfigReloader {
+	reloader := &ConfigReloader{path: path, current: cfg}
+	if buf, err := os.ReadFile(path); err == nil {
+		reloader.hash = sha256.Sum256(buf)
+	}
+	return reloader
+}
+
+// Reload loads and validates config.yaml, the result is picked up by the next ForRun
+func (reloader *ConfigReloader) Reload(reason string) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	if buf, err := os.ReadFile(reloader.path); err == nil {
+		reloader.hash = sha256.Sum256(buf)
+	}
+	cfg, err := cfghelper.Load(reloader.path)
+	if err != nil {
+		log.Error().Msgf("Reload: %s, but the new config is invalid, keeping the current one: %v", reason, err)
+		return
+	}
+	latest := reloader.current
+	if reloader.pending != nil {
+		latest = reloader.pending
+	}
+	if sections := restartSections(latest, cfg); len(sections) > 0 {
+		log.Warn().Msgf("Reload: Changes to %s are only used after a restart", strings.Join(sections, ", "))
+	}
+	reloader.pending = cfg
+	redactSecrets(cfg)
+	log.Info().Msgf("Reload: %s, the new config is used from the next run", reason)
+}
+
+// restartSections lists the changed parts of the config that are only read at startup
+func restartSections(old *cfghelper.Config, new *cfghelper.Config) []string {
+	var sections []string
+	if !reflect.DeepEqual(old.Schedule, new.Schedule) {
+		sections = append(sections, "Schedule")
+	}
+	if old.Run != new.Run {
+		sections = append(sections, "Run")
+	}
+	if old.Storage != new.Storage {
+		sections = append(sections, "Storage")
+	}
+	if old.Server != new.Server {
+		sections = append(sections, "Server")
+	}
+	if old.Log.Format != new.Log.Format {
+		sections = append(sections, "Log.Format")
+	}
+	return sections
+}
+
+// ForRun returns the config for a run that is starting, switching to a reloaded config if there is one
+func (reloader *ConfigReloader) ForRun() (*cfghelper.Config, bool) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	if reloader.pending == nil {
+		return reloader.current, false
+	}
+	reloader.current, reloader.pending = reloader.pending, nil
+	cfg := reloader.current
+	applyLogLevel(cfg.Log.Level)
+	SetupTimezones(cfg.ICS.TimezoneMappings)
+	return cfg, true
+}
+
+// watch checks config.yaml for changes every interval until ctx is done. The content is compared, not the
+// modification time, so a Kubernetes ConfigMap update, which swaps a symlink, is noticed too
+func (reloader *ConfigReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			buf, err := os.ReadFile(reloader.path)
+			if err != nil {
+				continue
+			}
+			reloader.mutex.Lock()
+			changed := sha256.Sum256(buf) != reloader.hash
+			reloader.mutex.Unlock()
+			if changed {
+				reloader.Reload("config.yaml changed")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// setupReload reloads on SIGHUP, and on changes to config.yaml unless watching is turned off
+func setupReload(ctx context.Context, reloader *ConfigReloader, reloadConfig cfghelper.ReloadConfig) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hangup)
+		for {
+			select {
+			case <-hangup:
+				reloader.Reload("SIGHUP received")
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if reloadConfig.Interval > 0 {
+		log.Info().Msgf("Reload: Checking %s for changes every %s", reloader.path, reloadConfig.Interval)
+		go reloader.watch(ctx, reloadConfig.Interval)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+	log "github.com/rs/zerolog/log"
+)
+
+// ConflictReport is the dry-run output, every open conflict with the email it would get
+type ConflictReport struct {
+	GeneratedAt time.Time           `json:"generatedAt"`
+	Conflicts   []ConflictReportRow `json:"conflicts"`
+}
+
+type ConflictReportRow struct {
+	Resource        string    `json:"resource"`
+	Calendar        string    `json:"calendar"`
+	Summary         string    `json:"summary"`
+	EventStart      time.Time `json:"eventStart"`
+	EventEnd        time.Time `json:"eventEnd"`
+	UID             string    `json:"uid"`
+	Source          string    `json:"source,omitempty"` // EXPO source of the booking
+	Booking         string    `json:"booking"`
+	BookingURL      string    `json:"bookingURL"`
+	BookingEvent    string    `json:"bookingEvent"`
+	BookingState    string    `json:"bookingState"`
+	BookingStart    time.Time `json:"bookingStart"`
+	BookingEnd      time.Time `json:"bookingEnd"`
+	Recipient       string    `json:"recipient"`
+	Fallback        bool      `json:"fallback"`        // No mapping for the summary, the fallback address would get the email
+	AlreadyNotified bool      `json:"alreadyNotified"` // The UID is in sent_emails.txt, so no email would be sent
+	FirstSeen       time.Time `json:"firstSeen"`
+}
+
+var reportColumns = []string{"Resource", "Calendar", "Summary", "Event start", "Event end", "UID", "EXPO source", "Booking", "Booking URL",
+	"Booking event", "Booking state", "Booking start", "Booking end", "Recipient", "Fallback", "Already notified", "First seen"}
+
+func (row ConflictReportRow) values() []string {
+	return []string{row.Resource, row.Calendar, row.Summary, row.EventStart.Format(time.RFC3339), row.EventEnd.Format(time.RFC3339),
+		row.UID, row.Source, row.Booking, row.BookingURL, row.BookingEvent, row.BookingState, row.BookingStart.Format(time.RFC3339), row.BookingEnd.Format(time.RFC3339),
+		row.Recipient, strconv.FormatBool(row.Fallback), strconv.FormatBool(row.AlreadyNotified), row.FirstSeen.Format(time.RFC3339)}
+}
+
+// buildConflictReport lists the conflicts with their recipient, sent_emails.txt is only read
+func buildConflictReport(ctx context.Context, conflicts []Conflict, mailSettings cfghelper.MailSettings) ConflictReport {
+	sent, err := sentEmailUIDs(sentEmailsFile)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("Report: Error reading sent emails: %v", err)
+	}
+	report := ConflictReport{GeneratedAt: time.Now(), Conflicts: make([]ConflictReportRow, 0, len(conflicts))}
+	for _, conflict := range conflicts {
+		overlap := conflict.Overlap
+		recipient, err := lookupEmail(ctx, overlap.icsSummary, &mailSettings)
+		if err != nil {
+			recipient = mailSettings.FallbackEmail.Address
+		}
+		report.Conflicts = append(report.Conflicts, ConflictReportRow{
+			Resource:        overlap.resourceName,
+			Calendar:        overlap.icsName,
+			Summary:         overlap.icsSummary,
+			EventStart:      overlap.icsStartTime,
+			EventEnd:        overlap.icsEndTime,
+			UID:             overlap.icsUID,
+			Source:          overlap.expoSource,
+			Booking:         overlap.expoHumanNumber,
+			BookingURL:      overlap.expoBookingURL,
+			BookingEvent:    overlap.expoEventName,
+			BookingState:    overlap.expoState,
+			BookingStart:    overlap.expoStartTime,
+			BookingEnd:      overlap.expoEndTime,
+			Recipient:       recipient,
+			Fallback:        err != nil,
+			AlreadyNotified: sent[overlap.icsUID],
+			FirstSeen:       conflict.FirstSeen,
+		})
+	}
+	return report
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="UTF-8">
+  <title>EXPO-Outlook-BookingHandler conflicts</title>
+  <style>
+    body { font-family: sans-serif; }
+    table { border-collapse: collapse; }
+    th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+  </style>
+</head>
+<body>
+  <h1>Conflicts</h1>
+  <p>Dry run generated {{time .GeneratedAt}}, {{len .Conflicts}} conflicts.</p>
+  <table>
+    <tr>{{range .Columns}}<th>{{.}}</th>{{end}}</tr>
+    {{range .Conflicts}}<tr>
+      <td>{{.Resource}}</td><td>{{.Calendar}}</td><td>{{.Summary}}</td><td>{{time .EventStart}}</td><td>{{time .EventEnd}}</td><td>{{.UID}}</td>
+      <td>{{.Source}}</td><td><a href="{{.BookingURL}}">{{.Booking}}</a></td><td>{{.BookingURL}}</td><td>{{.BookingEvent}}</td><td>{{.BookingState}}</td><td>{{time .BookingStart}}</td><td>{{time .BookingEnd}}</td>
+      <td>{{.Recipient}}</td><td>{{.Fallback}}</td><td>{{.AlreadyNotified}}</td><td>{{time .FirstSeen}}</td>
+    </tr>
+    {{end}}
+  </table>
+</body>
+</html>
+`))
+
+// writeConflictReport writes the report as json, csv or html
+func writeConflictReport(out io.Writer, format string, report ConflictReport) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "csv":
+		writer := csv.NewWriter(out)
+		writer.Write(reportColumns)
+		for _, row := range report.Conflicts {
+			writer.Write(row.values())
+		}
+		writer.Flush()
+		return writer.Error()
+	case "html":
+		return reportTemplate.Execute(out, map[string]interface{}{
+			"GeneratedAt": report.GeneratedAt,
+			"Columns":     reportColumns,
+			"Conflicts":   report.Conflicts,
+		})
+	default:
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+}
+
+// reportPath is DryRun.Path, or conflict-report.<format> in the data directory
+func reportPath(dryRun cfghelper.DryRunConfig) string {
+	if dryRun.Path != "" {
+		return dryRun.Path
+	}
+	return filepath.Join(dataDir, "conflict-report."+dryRun.Format)
+}
+
+// saveConflictReport writes the report of all open conflicts, a path of - writes to stdout
+func saveConflictReport(ctx context.Context, cfg *cfghelper.Config) error {
+	report := buildConflictReport(ctx, conflictState.Snapshot(), cfg.Email)
+	path := reportPath(cfg.DryRun)
+	if path == "-" {
+		return writeConflictReport(os.Stdout, cfg.DryRun.Format, report)
+	}
+	err := writeFileAtomic(path, func(out io.Writer) error {
+		return writeConflictReport(out, cfg.DryRun.Format, report)
+	})
+	if err != nil {
+		return err
+	}
+	log.Ctx(ctx).Info().Msgf("Report: Dry run report with %d conflicts written to %s", len(report.Conflicts), path)
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+	"github.com/robfig/cron/v3"
+	log "github.com/rs/zerolog/log"
+)
+
+// Schedule computes when the next check should run from cron expressions, time windows and holidays
+type Schedule struct {
+	crons    []cron.Schedule
+	windows  []scheduleWindow
+	every    time.Duration
+	holidays map[string]bool
+}
+
+type scheduleWindow struct {
+	days  map[time.Weekday]bool // Empty means every day
+	from  time.Duration         // Offset from midnight
+	to    time.Duration
+	every time.Duration
+}
+
+// NewSchedule builds the schedule from a config checked by Load, if it is empty checks run every Interval
+func NewSchedule(scheduleConfig cfghelper.ScheduleConfig) *Schedule {
+	if scheduleConfig.IsEmpty() {
+		scheduleConfig.Every = scheduleConfig.Interval
+	}
+	schedule := &Schedule{crons: scheduleConfig.Crons, every: scheduleConfig.Every, holidays: make(map[string]bool)}
+	for _, window := range scheduleConfig.Windows {
+		parsed := scheduleWindow{days: make(map[time.Weekday]bool), from: window.Start, to: window.End, every: window.Every}
+		for _, weekday := range window.Weekdays {
+			parsed.days[weekday] = true
+		}
+		schedule.windows = append(schedule.windows, parsed)
+	}
+	for _, holiday := range scheduleConfig.Holidays {
+		schedule.holidays[holiday] = true
+	}
+	return schedule
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// atClock returns the wall clock time on the day of t, this stays correct on days with a DST switch
+func atClock(t time.Time, clock time.Duration) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, int(clock/time.Minute), 0, 0, t.Location())
+}
+
+func clockOf(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+func (window scheduleWindow) appliesTo(day time.Weekday) bool {
+	return len(window.days) == 0 || window.days[day]
+}
+
+// Next returns the first run after the given time that is not on a holiday
+func (schedule *Schedule) Next(after time.Time) time.Time {
+	// A year of holidays in a row is surely a config mistake, stop looking after that
+	for range 366 {
+		next := schedule.nextCandidate(after)
+		if !schedule.holidays[next.Format(time.DateOnly)] {
+			return next
+		}
+		// Continue looking from the start of the next day, an interval schedule restarts right at midnight
+		midnight := startOfDay(next).AddDate(0, 0, 1)
+		if schedule.every > 0 && !schedule.holidays[midnight.Format(time.DateOnly)] {
+			return midnight
+		}
+		after = midnight.Add(-time.Nanosecond)
+	}
+	return time.Time{}
+}
+
+func (schedule *Schedule) nextCandidate(after time.Time) time.Time {
+	var next time.Time
+	for _, parsed := range schedule.crons {
+		if candidate := parsed.Next(after); !candidate.IsZero() && (next.IsZero() || candidate.Before(next)) {
+			next = candidate
+		}
+	}
+	if len(schedule.windows) > 0 || schedule.every > 0 {
+		if candidate := schedule.nextInterval(after); !candidate.IsZero() && (next.IsZero() || candidate.Before(next)) {
+			next = candidate
+		}
+	}
+	return next
+}
+
+// nextInterval uses the interval of the window we are in, or the default interval outside windows.
+// A window starting before that interval has passed moves the run to the window start
+func (schedule *Schedule) nextInterval(after time.Time) time.Time {
+	var next time.Time
+	every := schedule.every
+	clock := clockOf(after)
+	for _, window := range schedule.windows {
+		if window.appliesTo(after.Weekday()) && clock >= window.from && clock < window.to {
+			every = window.every
+			break
+		}
+	}
+	if every > 0 {
+		next = after.Add(every)
+	}
+	if windowStart := schedule.nextWindowStart(after); !windowStart.IsZero() && (next.IsZero() || windowStart.Before(next)) {
+		next = windowStart
+	}
+	return next
+}
+
+func (schedule *Schedule) nextWindowStart(after time.Time) time.Time {
+	var next time.Time
+	for days := range 8 {
+		day := startOfDay(after).AddDate(0, 0, days)
+		for _, window := range schedule.windows {
+			if !window.appliesTo(day.Weekday()) {
+				continue
+			}
+			start := atClock(day, window.from)
+			if start.After(after) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+	return next
+}
+
+// Active reports if the schedule runs checks at the given time: not on a holiday, and inside a window when checks
+// only run in windows. Cron expressions only set run times, so they do not make a time active
+func (schedule *Schedule) Active(at time.Time) bool {
+	if schedule.holidays[at.Format(time.DateOnly)] {
+		return false
+	}
+	if len(schedule.windows) == 0 || schedule.every > 0 {
+		return true
+	}
+	clock := clockOf(at)
+	for _, window := range schedule.windows {
+		if window.appliesTo(at.Weekday()) && clock >= window.from && clock < window.to {
+			return true
+		}
+	}
+	return false
+}
+
+// setupSchedule triggers the scheduler at every run time of the schedule until ctx is done
+func setupSchedule(ctx context.Context, schedule *Schedule, scheduler *Scheduler) {
+	go func() {
+		for {
+			next := schedule.Next(time.Now())
+			if next.IsZero() {
+				log.Warn().Msg("Schedule: No upcoming runs found, stopping the schedule")
+				return
+			}
+			log.Info().Msgf("Schedule: Next check at %s", next.Format(time.RFC3339))
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-timer.C:
+				log.Print("Schedule triggered, checking overlaps...")
+				scheduler.Trigger(ctx, fullTier)
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
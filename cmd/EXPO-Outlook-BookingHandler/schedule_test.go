@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+)
+
+func TestScheduleActive(t *testing.T) {
+	// The parsed fields are set by Load
+	weekdayWindow := cfghelper.ScheduleWindow{
+		Weekdays: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		Start:    7 * time.Hour,
+		End:      18 * time.Hour,
+		Every:    5 * time.Minute,
+	}
+	tests := []struct {
+		name   string
+		config cfghelper.ScheduleConfig
+		at     time.Time
+		want   bool
+	}{
+		{"interval", cfghelper.ScheduleConfig{Interval: 30 * time.Minute}, time.Date(2026, 12, 23, 3, 0, 0, 0, time.UTC), true},
+		{"holiday", cfghelper.ScheduleConfig{Interval: 30 * time.Minute, Holidays: []string{"2026-12-24"}}, time.Date(2026, 12, 24, 10, 0, 0, 0, time.UTC), false},
+		{"inside window", cfghelper.ScheduleConfig{Windows: []cfghelper.ScheduleWindow{weekdayWindow}}, time.Date(2026, 12, 23, 10, 0, 0, 0, time.UTC), true},
+		{"outside window", cfghelper.ScheduleConfig{Windows: []cfghelper.ScheduleWindow{weekdayWindow}}, time.Date(2026, 12, 23, 20, 0, 0, 0, time.UTC), false},
+		{"weekend", cfghelper.ScheduleConfig{Windows: []cfghelper.ScheduleWindow{weekdayWindow}}, time.Date(2026, 12, 26, 10, 0, 0, 0, time.UTC), false},
+		{"outside window with Every", cfghelper.ScheduleConfig{Windows: []cfghelper.ScheduleWindow{weekdayWindow}, Every: time.Hour}, time.Date(2026, 12, 23, 20, 0, 0, 0, time.UTC), true},
+		{"holiday inside window", cfghelper.ScheduleConfig{Windows: []cfghelper.ScheduleWindow{weekdayWindow}, Holidays: []string{"2026-12-24"}}, time.Date(2026, 12, 24, 10, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		if got := NewSchedule(test.config).Active(test.at); got != test.want {
+			t.Errorf("%s: Active(%s) = %v, want %v", test.name, test.at.Format(time.RFC3339), got, test.want)
+		}
+	}
+}
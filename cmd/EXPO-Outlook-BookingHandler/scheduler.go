@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	cfghelper "github.com/Teknikens-Hus/EXPO-Outlook-BookingHandler/internal/conf"
+	log "github.com/rs/zerolog/log"
+)
+
+// Scheduler makes sure only one check runs at a time, a run that is due while one is running is skipped or queued
+type Scheduler struct {
+	run       func(ctx context.Context, tier cfghelper.TierConfig)
+	runConfig cfghelper.RunConfig
+	mutex     sync.Mutex
+	running   bool
+	queued    *cfghelper.TierConfig
+	wg        sync.WaitGroup
+}
+
+// fullTier is a run of the whole window from GetMonthDateRange
+var fullTier = cfghelper.TierConfig{Name: "full"}
+
+func NewScheduler(runConfig cfghelper.RunConfig, run func(ctx context.Context, tier cfghelper.TierConfig)) *Scheduler {
+	return &Scheduler{run: run, runConfig: runConfig}
+}
+
+// Trigger starts a run of the tier in the background, cancelling ctx stops the run and any queued run
+func (scheduler *Scheduler) Trigger(ctx context.Context, tier cfghelper.TierConfig) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if scheduler.running {
+		if scheduler.runConfig.OnOverlap == "queue" {
+			// Only one run is queued, keep the one covering the widest window
+			if scheduler.queued == nil || isWiderTier(tier, *scheduler.queued) {
+				scheduler.queued = &tier
+			}
+			log.Printf("Scheduler: Previous run still in progress, queueing the next run: %s", scheduler.queued.Name)
+		} else {
+			log.Warn().Msgf("Scheduler: Previous run still in progress, skipping this run: %s", tier.Name)
+		}
+		return
+	}
+	scheduler.running = true
+	scheduler.wg.Add(1)
+	go scheduler.loop(ctx, tier)
+}
+
+func isWiderTier(tier cfghelper.TierConfig, other cfghelper.TierConfig) bool {
+	if other.Horizon == 0 {
+		return false
+	}
+	return tier.Horizon == 0 || tier.Horizon > other.Horizon
+}
+
+func (scheduler *Scheduler) loop(ctx context.Context, tier cfghelper.TierConfig) {
+	defer scheduler.wg.Done()
+	for {
+		scheduler.runOnce(ctx, tier)
+		scheduler.mutex.Lock()
+		if scheduler.queued == nil || ctx.Err() != nil {
+			scheduler.running, scheduler.queued = false, nil
+			scheduler.mutex.Unlock()
+			return
+		}
+		tier, scheduler.queued = *scheduler.queued, nil
+		scheduler.mutex.Unlock()
+		log.Printf("Scheduler: Starting queued run: %s", tier.Name)
+	}
+}
+
+func (scheduler *Scheduler) runOnce(ctx context.Context, tier cfghelper.TierConfig) {
+	runCtx, cancel := context.WithTimeout(withRunID(ctx), scheduler.runConfig.Timeout)
+	defer cancel()
+	started := time.Now()
+	scheduler.run(runCtx, tier)
+	if err := runCtx.Err(); err != nil {
+		log.Ctx(runCtx).Warn().Msgf("Scheduler: Run %s stopped after %s: %v", tier.Name, time.Since(started).Round(time.Millisecond), err)
+		return
+	}
+	log.Ctx(runCtx).Info().Msgf("Scheduler: Run %s finished in %s", tier.Name, time.Since(started).Round(time.Millisecond))
+}
+
+// setupTiers triggers a run of each tier at its own interval until ctx is done, skipping the times the schedule is
+// not active
+func setupTiers(ctx context.Context, tiers []cfghelper.TierConfig, schedule *Schedule, scheduler *Scheduler) {
+	for _, tier := range tiers {
+		log.Info().Msgf("Scheduler: Checking %s every %s", tier.Name, tier.Every)
+		go func() {
+			ticker := time.NewTicker(tier.Every)
+			defer ticker.Stop()
+			for {
+				select {
+				case now := <-ticker.C:
+					if !schedule.Active(now) {
+						log.Printf("Scheduler: Skipping %s, outside the schedule", tier.Name)
+						continue
+					}
+					scheduler.Trigger(ctx, tier)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Wait blocks until the current run, if any, has finished
+func (scheduler *Scheduler) Wait() {
+	scheduler.wg.Wait()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/rs/zerolog/log"
+)
+
+// dataDir holds everything that is kept between runs and restarts, mounted as a volume in Docker and Kubernetes.
+// It is Storage.DataDir, set by setDataDir at startup
+var (
+	dataDir        = "/app/data"
+	stateFile      = filepath.Join(dataDir, "state.json")
+	sentEmailsFile = filepath.Join(dataDir, "sent_emails.txt")
+	lockFile       = filepath.Join(dataDir, ".lock")
+)
+
+func setDataDir(dir string) {
+	dataDir = dir
+	stateFile = filepath.Join(dir, "state.json")
+	sentEmailsFile = filepath.Join(dir, "sent_emails.txt")
+	lockFile = filepath.Join(dir, ".lock")
+}
+
+// savedState is the conflict and calendar health state, saved after every run so a restart or the next
+// CronJob run continues where the last one stopped
+type savedState struct {
+	SavedAt   time.Time        `json:"savedAt"`
+	Conflicts []savedConflict  `json:"conflicts"`
+	Calendars []CalendarHealth `json:"calendars"`
+}
+
+type savedConflict struct {
+	Resource     string    `json:"resource"`
+	BookingURL   string    `json:"bookingURL"`
+	Booking      string    `json:"booking"`
+	BookingEvent string    `json:"bookingEvent"`
+	BookingStart time.Time `json:"bookingStart"`
+	BookingEnd   time.Time `json:"bookingEnd"`
+	UID          string    `json:"uid"`
+	Summary      string    `json:"summary"`
+	EventStart   time.Time `json:"eventStart"`
+	EventEnd     time.Time `json:"eventEnd"`
+	Calendar     string    `json:"calendar"`
+	BookingState string    `json:"bookingState,omitempty"`
+	Source       string    `json:"source,omitempty"`
+	FirstSeen    time.Time `json:"firstSeen"`
+	LastSeen     time.Time `json:"lastSeen"`
+}
+
+// loadState restores the state saved by saveState, a missing file is not an error
+func loadState(ctx context.Context, path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var state savedState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return err
+	}
+	conflicts := make([]Conflict, 0, len(state.Conflicts))
+	for _, saved := range state.Conflicts {
+		conflicts = append(conflicts, Conflict{
+			Overlap: Overlap{
+				resourceName:    saved.Resource,
+				expoBookingURL:  saved.BookingURL,
+				expoHumanNumber: saved.Booking,
+				expoEventName:   saved.BookingEvent,
+				expoStartTime:   saved.BookingStart,
+				expoEndTime:     saved.BookingEnd,
+				icsUID:          saved.UID,
+				icsSummary:      saved.Summary,
+				icsStartTime:    saved.EventStart,
+				icsEndTime:      saved.EventEnd,
+				icsName:         saved.Calendar,
+				expoState:       saved.BookingState,
+				expoSource:      saved.Source,
+			},
+			FirstSeen: saved.FirstSeen,
+			LastSeen:  saved.LastSeen,
+		})
+	}
+	conflictState.Restore(conflicts)
+	calendarHealth.Restore(state.Calendars)
+	log.Ctx(ctx).Info().Msgf("State: Restored %d conflicts and %d calendars saved at %s", len(conflicts), len(state.Calendars), state.SavedAt.Format(time.RFC3339))
+	return nil
+}
+
+// saveState writes the current conflicts and calendar health to path
+func saveState(path string) error {
+	state := savedState{SavedAt: time.Now(), Calendars: calendarHealth.Snapshot()}
+	for _, conflict := range conflictState.Snapshot() {
+		overlap := conflict.Overlap
+		state.Conflicts = append(state.Conflicts, savedConflict{
+			Resource:     overlap.resourceName,
+			BookingURL:   overlap.expoBookingURL,
+			Booking:      overlap.expoHumanNumber,
+			BookingEvent: overlap.expoEventName,
+			BookingStart: overlap.expoStartTime,
+			BookingEnd:   overlap.expoEndTime,
+			UID:          overlap.icsUID,
+			Summary:      overlap.icsSummary,
+			EventStart:   overlap.icsStartTime,
+			EventEnd:     overlap.icsEndTime,
+			Calendar:     overlap.icsName,
+			BookingState: overlap.expoState,
+			Source:       overlap.expoSource,
+			FirstSeen:    conflict.FirstSeen,
+			LastSeen:     conflict.LastSeen,
+		})
+	}
+	return writeFileAtomic(path, func(out io.Writer) error {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(state)
+	})
+}
+
+// writeFileAtomic writes to a temporary file and renames it over path, so a reader never sees half a file
+func writeFileAtomic(path string, write func(out io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	// CreateTemp only allows the owner to read the file
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
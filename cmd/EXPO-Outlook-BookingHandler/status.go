@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunStatus is the result of one check run, as shown by /status
+type RunStatus struct {
+	ID                string           `json:"id"` // Correlation ID, the run field of its log lines
+	Window            string           `json:"window"`
+	WindowStart       time.Time        `json:"windowStart"`
+	WindowEnd         time.Time        `json:"windowEnd"`
+	StartedAt         time.Time        `json:"startedAt"`
+	Duration          string           `json:"duration"`
+	Success           bool             `json:"success"`
+	Error             string           `json:"error,omitempty"`
+	EXPO              EXPOStatus       `json:"expo"`
+	EXPOSources       []EXPOStatus     `json:"expoSources,omitempty"` // Every source, when there are several
+	Calendars         []CalendarStatus `json:"calendars"`
+	ConflictsFound    int              `json:"conflictsFound"`
+	ConflictsNotified int              `json:"conflictsNotified"`
+	NotifyErrors      []string         `json:"notifyErrors,omitempty"` // Notifications that could not be sent
+}
+
+type EXPOStatus struct {
+	Name       string `json:"name,omitempty"`
+	Success    bool   `json:"success"`
+	Bookings   int    `json:"bookings"`             // Bookings left after filtering
+	Incomplete bool   `json:"incomplete,omitempty"` // The fetch stopped early, Error tells why
+	Error      string `json:"error,omitempty"`
+}
+
+// combineEXPOStatus sums up the sources of a run. The fetch succeeded if any source did, and it is incomplete if
+// any source failed or was incomplete, so the run is a partial failure
+func combineEXPOStatus(sources []EXPOStatus) EXPOStatus {
+	if len(sources) == 1 {
+		combined := sources[0]
+		combined.Name = ""
+		return combined
+	}
+	var combined EXPOStatus
+	var errs []string
+	for _, source := range sources {
+		combined.Success = combined.Success || source.Success
+		combined.Bookings += source.Bookings
+		if !source.Success || source.Incomplete {
+			errs = append(errs, source.Name+": "+source.Error)
+		}
+	}
+	combined.Incomplete = combined.Success && len(errs) > 0
+	combined.Error = strings.Join(errs, "; ")
+	return combined
+}
+
+type CalendarStatus struct {
+	Name                string    `json:"name"`
+	Success             bool      `json:"success"`
+	Events              int       `json:"events"`
+	Error               string    `json:"error,omitempty"`
+	LastSuccess         time.Time `json:"lastSuccess,omitzero"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	UnhealthySince      time.Time `json:"unhealthySince,omitzero"`
+}
+
+// StatusTracker keeps the last run for /status and decides readiness for /readyz
+type StatusTracker struct {
+	mutex       sync.Mutex
+	lastRun     *RunStatus
+	lastFullRun *RunStatus
+	ready       bool
+}
+
+var runStatus = &StatusTracker{}
+
+// Record stores a finished run, the service is ready after the first successful run and while EXPO can be reached
+func (tracker *StatusTracker) Record(status RunStatus) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.lastRun = &status
+	if status.Window == fullTier.Name {
+		tracker.lastFullRun = &status
+	}
+	if status.Success {
+		tracker.ready = true
+	} else if !status.EXPO.Success {
+		tracker.ready = false
+	}
+}
+
+func (tracker *StatusTracker) Ready() bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return tracker.ready
+}
+
+// StatusResponse is the JSON returned by /status
+type StatusResponse struct {
+	Version       string     `json:"version"`
+	Ready         bool       `json:"ready"`
+	LastRun       *RunStatus `json:"lastRun"`
+	LastFullRun   *RunStatus `json:"lastFullRun"`
+	OpenConflicts int        `json:"openConflicts"`
+}
+
+func (tracker *StatusTracker) Response(version string) StatusResponse {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return StatusResponse{
+		Version:       version,
+		Ready:         tracker.ready,
+		LastRun:       tracker.lastRun,
+		LastFullRun:   tracker.lastFullRun,
+		OpenConflicts: conflictState.Count(),
+	}
+}
+
+// calendarStatuses merges the results of a run with the health of each calendar
+func calendarStatuses(names []string, results []calendarResult) []CalendarStatus {
+	health := make(map[string]CalendarHealth)
+	for _, calendar := range calendarHealth.Snapshot() {
+		health[calendar.Name] = calendar
+	}
+	statuses := make([]CalendarStatus, 0, len(names))
+	for i, name := range names {
+		status := CalendarStatus{
+			Name:                name,
+			Success:             results[i].err == nil,
+			Events:              len(results[i].events),
+			LastSuccess:         health[name].LastSuccess,
+			ConsecutiveFailures: health[name].ConsecutiveFailures,
+			UnhealthySince:      health[name].UnhealthySince,
+		}
+		if results[i].err != nil {
+			status.Error = results[i].err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
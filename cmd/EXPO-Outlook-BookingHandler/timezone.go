@@ -0,0 +1,303 @@
+package main
+
+//go:generate go run gen_windowszones.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/rs/zerolog/log"
+)
+
+var timezoneMutex sync.RWMutex
+
+// User mappings from config.yaml, checked before the built-in Windows table
+var timezoneOverrides map[string]string
+
+// SetupTimezones sets the user mappings, overrides map TZIDs to IANA names
+func SetupTimezones(overrides map[string]string) {
+	timezoneMutex.Lock()
+	timezoneOverrides = overrides
+	timezoneMutex.Unlock()
+}
+
+// resolveTZID maps a TZID from an ICS feed to a location, trying in order:
+// config overrides, the CLDR Windows zones, IANA names and last the VTIMEZONEs of the feed
+func resolveTZID(tzid string, feed map[string]*time.Location) (*time.Location, error) {
+	name := normalizeTZID(tzid)
+	timezoneMutex.RLock()
+	defer timezoneMutex.RUnlock()
+	if iana, ok := lookupFold(timezoneOverrides, name); ok {
+		return time.LoadLocation(iana)
+	}
+	if iana, ok := lookupFold(windowsZones, name); ok {
+		return time.LoadLocation(iana)
+	}
+	if loc, err := loadIANA(name); err == nil {
+		return loc, nil
+	}
+	if loc, ok := feed[name]; ok {
+		return loc, nil
+	}
+	return nil, fmt.Errorf("unknown timezone: %s", tzid)
+}
+
+func normalizeTZID(tzid string) string {
+	tzid = strings.Trim(strings.TrimSpace(tzid), `"`)
+	return strings.TrimPrefix(tzid, "tzone://Microsoft/")
+}
+
+func lookupFold(mapping map[string]string, name string) (string, bool) {
+	if value, ok := mapping[name]; ok {
+		return value, true
+	}
+	for key, value := range mapping {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// loadIANA loads an IANA name, also handling prefixed TZIDs like /mozilla.org/20050126_1/Europe/Berlin
+func loadIANA(name string) (*time.Location, error) {
+	if name == "" || strings.EqualFold(name, "Local") {
+		return nil, fmt.Errorf("not an IANA timezone: %s", name)
+	}
+	loc, err := time.LoadLocation(name)
+	if err == nil || !strings.HasPrefix(name, "/") {
+		return loc, err
+	}
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		if loc, err := time.LoadLocation(strings.Join(parts[i:], "/")); err == nil {
+			return loc, nil
+		}
+	}
+	return nil, err
+}
+
+type vtimezoneRule struct {
+	start    time.Time // DTSTART in local time, the zone of the value is ignored
+	offsetTo int       // TZOFFSETTO in seconds east of UTC
+	name     string
+	rrule    map[string]string
+}
+
+// feedTimezones parses the VTIMEZONE blocks of a feed so they can be used as a fallback for that feed
+func feedTimezones(ctx context.Context, body string) map[string]*time.Location {
+	zones := make(map[string]*time.Location)
+	for tzid, rules := range parseVTimezones(body) {
+		loc, err := buildVTimezoneLocation(tzid, rules["STANDARD"], rules["DAYLIGHT"])
+		if err != nil {
+			log.Ctx(ctx).Warn().Msgf("ICS: Could not use VTIMEZONE %s: %v", tzid, err)
+			continue
+		}
+		zones[normalizeTZID(tzid)] = loc
+	}
+	return zones
+}
+
+// parseVTimezones returns the latest STANDARD and DAYLIGHT rule for each TZID
+func parseVTimezones(body string) map[string]map[string]*vtimezoneRule {
+	// Unfold continuation lines
+	body = strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(body)
+	timezones := make(map[string]map[string]*vtimezoneRule)
+	var tzid, component string
+	var current *vtimezoneRule
+	inTimezone := false
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		name, _, _ := strings.Cut(key, ";")
+		name = strings.ToUpper(name)
+		switch {
+		case name == "BEGIN" && value == "VTIMEZONE":
+			inTimezone, tzid = true, ""
+		case name == "END" && value == "VTIMEZONE":
+			inTimezone = false
+		case !inTimezone:
+			continue
+		case name == "TZID" && current == nil:
+			tzid = value
+		case name == "BEGIN" && (value == "STANDARD" || value == "DAYLIGHT"):
+			component, current = value, &vtimezoneRule{}
+		case name == "END" && current != nil:
+			if tzid != "" {
+				if timezones[tzid] == nil {
+					timezones[tzid] = make(map[string]*vtimezoneRule)
+				}
+				if previous := timezones[tzid][component]; previous == nil || !current.start.Before(previous.start) {
+					timezones[tzid][component] = current
+				}
+			}
+			current = nil
+		case current == nil:
+			continue
+		case name == "DTSTART":
+			current.start, _ = time.Parse("20060102T150405", strings.TrimSuffix(value, "Z"))
+		case name == "TZOFFSETTO":
+			current.offsetTo, _ = parseUTCOffset(value)
+		case name == "TZNAME":
+			current.name = value
+		case name == "RRULE":
+			current.rrule = make(map[string]string)
+			for _, part := range strings.Split(value, ";") {
+				if k, v, ok := strings.Cut(part, "="); ok {
+					current.rrule[strings.ToUpper(k)] = strings.ToUpper(v)
+				}
+			}
+		}
+	}
+	return timezones
+}
+
+// parseUTCOffset parses a TZOFFSETTO value like +0100, -0500 or +013000 to seconds
+func parseUTCOffset(value string) (int, error) {
+	if len(value) != 5 && len(value) != 7 {
+		return 0, fmt.Errorf("invalid UTC offset: %s", value)
+	}
+	sign := 1
+	switch value[0] {
+	case '-':
+		sign = -1
+	case '+':
+	default:
+		return 0, fmt.Errorf("invalid UTC offset: %s", value)
+	}
+	seconds := 0
+	for i, unit := range []int{3600, 60, 1} {
+		if 1+i*2 >= len(value) {
+			break
+		}
+		n, err := strconv.Atoi(value[1+i*2 : 3+i*2])
+		if err != nil {
+			return 0, fmt.Errorf("invalid UTC offset: %s", value)
+		}
+		seconds += n * unit
+	}
+	return sign * seconds, nil
+}
+
+// buildVTimezoneLocation turns the yearly rules into a POSIX TZ string, which Go can use through a TZif footer
+func buildVTimezoneLocation(tzid string, standard, daylight *vtimezoneRule) (*time.Location, error) {
+	if standard == nil && daylight == nil {
+		return nil, fmt.Errorf("no STANDARD or DAYLIGHT rule")
+	}
+	if standard == nil || daylight == nil || standard.rrule == nil || daylight.rrule == nil {
+		// No yearly switch, the zone has a fixed offset
+		rule := standard
+		if rule == nil {
+			rule = daylight
+		}
+		return time.FixedZone(tzid, rule.offsetTo), nil
+	}
+	daylightStart, err := posixRule(daylight)
+	if err != nil {
+		return nil, err
+	}
+	daylightEnd, err := posixRule(standard)
+	if err != nil {
+		return nil, err
+	}
+	stdName := posixName(standard.name, "STD")
+	tz := stdName + posixOffset(standard.offsetTo) +
+		posixName(daylight.name, "DST") + posixOffset(daylight.offsetTo) +
+		"," + daylightStart + "," + daylightEnd
+	return time.LoadLocationFromTZData(tzid, tzifWithFooter(standard.offsetTo, stdName, tz))
+}
+
+var posixWeekdays = map[string]int{"SU": 0, "MO": 1, "TU": 2, "WE": 3, "TH": 4, "FR": 5, "SA": 6}
+
+// posixRule converts a yearly RRULE like FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU to Mm.w.d/hh:mm:ss
+func posixRule(rule *vtimezoneRule) (string, error) {
+	if rule.rrule["FREQ"] != "YEARLY" {
+		return "", fmt.Errorf("unsupported RRULE frequency: %s", rule.rrule["FREQ"])
+	}
+	month, err := strconv.Atoi(rule.rrule["BYMONTH"])
+	if err != nil || month < 1 || month > 12 {
+		return "", fmt.Errorf("unsupported RRULE BYMONTH: %s", rule.rrule["BYMONTH"])
+	}
+	byDay := rule.rrule["BYDAY"]
+	if len(byDay) < 2 {
+		return "", fmt.Errorf("unsupported RRULE BYDAY: %s", byDay)
+	}
+	weekday, ok := posixWeekdays[byDay[len(byDay)-2:]]
+	if !ok {
+		return "", fmt.Errorf("unsupported RRULE BYDAY: %s", byDay)
+	}
+	week := 0
+	if prefix := byDay[:len(byDay)-2]; prefix != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(prefix, "+"))
+		switch {
+		case err != nil:
+			return "", fmt.Errorf("unsupported RRULE BYDAY: %s", byDay)
+		case n == -1:
+			week = 5 // POSIX week 5 is the last week of the month
+		case n >= 1 && n <= 4:
+			week = n
+		default:
+			return "", fmt.Errorf("unsupported RRULE BYDAY: %s", byDay)
+		}
+	} else {
+		// Older style like BYDAY=SU;BYMONTHDAY=8,9,10,11,12,13,14
+		first, err := strconv.Atoi(strings.Split(rule.rrule["BYMONTHDAY"], ",")[0])
+		if err != nil || first < 1 {
+			return "", fmt.Errorf("unsupported RRULE without week: %s", byDay)
+		}
+		week = min((first-1)/7+1, 5)
+	}
+	return fmt.Sprintf("M%d.%d.%d/%02d:%02d:%02d", month, week, weekday, rule.start.Hour(), rule.start.Minute(), rule.start.Second()), nil
+}
+
+func posixName(name string, fallback string) string {
+	clean := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '+' || r == '-' {
+			return r
+		}
+		return -1
+	}, name)
+	if len(clean) < 3 {
+		clean = fallback
+	}
+	return "<" + clean + ">"
+}
+
+// posixOffset formats seconds east of UTC, POSIX uses the inverted sign
+func posixOffset(offset int) string {
+	sign := "-"
+	if offset <= 0 {
+		sign, offset = "", -offset
+	}
+	return fmt.Sprintf("%s%d:%02d:%02d", sign, offset/3600, offset/60%60, offset%60)
+}
+
+// tzifWithFooter builds a TZif version 2 file without transitions, so Go uses the footer TZ string for all times
+func tzifWithFooter(offset int, name string, tz string) []byte {
+	abbr := strings.Trim(name, "<>") + "\x00"
+	var buf bytes.Buffer
+	// The version 1 and version 2 blocks only differ in the size of transition times, and we have none
+	for range 2 {
+		buf.WriteString("TZif2")
+		buf.Write(make([]byte, 15))
+		// isutcnt, isstdcnt, leapcnt, timecnt, typecnt, charcnt
+		for _, n := range []uint32{0, 0, 0, 0, 1, uint32(len(abbr))} {
+			binary.Write(&buf, binary.BigEndian, n)
+		}
+		binary.Write(&buf, binary.BigEndian, int32(offset))
+		buf.WriteByte(0) // isdst
+		buf.WriteByte(0) // abbreviation index
+		buf.WriteString(abbr)
+	}
+	buf.WriteString("\n" + tz + "\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestResolveTZID(t *testing.T) {
+	SetupTimezones(map[string]string{"Custom Office Time": "Europe/Stockholm"})
+	t.Cleanup(func() { SetupTimezones(nil) })
+	tests := []struct {
+		tzid string
+		want string
+	}{
+		{"W. Europe Standard Time", "Europe/Berlin"},
+		{"w. europe standard time", "Europe/Berlin"},
+		{`"W. Europe Standard Time"`, "Europe/Berlin"},
+		{" \"Eastern Standard Time\" ", "America/New_York"},
+		{"tzone://Microsoft/W. Europe Standard Time", "Europe/Berlin"},
+		{`"tzone://Microsoft/Eastern Standard Time"`, "America/New_York"},
+		{"Europe/Stockholm", "Europe/Stockholm"},
+		{"/mozilla.org/20050126_1/Europe/Berlin", "Europe/Berlin"},
+		{"Custom Office Time", "Europe/Stockholm"},
+	}
+	for _, test := range tests {
+		loc, err := resolveTZID(test.tzid, nil)
+		if err != nil {
+			t.Errorf("resolveTZID(%q) returned error: %v", test.tzid, err)
+			continue
+		}
+		if loc.String() != test.want {
+			t.Errorf("resolveTZID(%q) = %s, want %s", test.tzid, loc, test.want)
+		}
+	}
+	if _, err := resolveTZID("Not A Real Zone", nil); err == nil {
+		t.Error("resolveTZID of an unknown zone returned no error")
+	}
+}
+
+// A VTIMEZONE like Outlook writes it, with the last week as BYDAY=-1SU
+const vtimezoneLastWeek = `BEGIN:VCALENDAR
+BEGIN:VTIMEZONE
+TZID:Test Central Europe
+BEGIN:STANDARD
+DTSTART:16010101T030000
+TZOFFSETFROM:+0200
+TZOFFSETTO:+0100
+TZNAME:CET
+RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=10
+END:STANDARD
+BEGIN:DAYLIGHT
+DTSTART:16010101T020000
+TZOFFSETFROM:+0100
+TZOFFSETTO:+0200
+TZNAME:CEST
+RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=3
+END:DAYLIGHT
+END:VTIMEZONE
+END:VCALENDAR
+`
+
+// The older form with the week given by BYMONTHDAY, here the US rules
+const vtimezoneMonthDay = `BEGIN:VCALENDAR
+BEGIN:VTIMEZONE
+TZID:Test Eastern
+BEGIN:STANDARD
+DTSTART:19671029T020000
+TZOFFSETFROM:-0400
+TZOFFSETTO:-0500
+TZNAME:EST
+RRULE:FREQ=YEARLY;BYMONTH=11;BYDAY=SU;BYMONTHDAY=1,2,3,4,5,6,7
+END:STANDARD
+BEGIN:DAYLIGHT
+DTSTART:19870405T020000
+TZOFFSETFROM:-0500
+TZOFFSETTO:-0400
+TZNAME:EDT
+RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=SU;BYMONTHDAY=8,9,10,11,12,13,14
+END:DAYLIGHT
+END:VTIMEZONE
+END:VCALENDAR
+`
+
+func TestVTimezoneLocation(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		tzid   string
+		checks []struct {
+			utc    time.Time
+			offset int
+		}
+	}{
+		{
+			name: "BYDAY=-1SU",
+			body: vtimezoneLastWeek,
+			tzid: "Test Central Europe",
+			checks: []struct {
+				utc    time.Time
+				offset int
+			}{
+				// Spring switch 2026-03-29 02:00 CET, autumn switch 2026-10-25 03:00 CEST
+				{time.Date(2026, 3, 29, 0, 59, 59, 0, time.UTC), 3600},
+				{time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC), 7200},
+				{time.Date(2026, 10, 25, 0, 59, 59, 0, time.UTC), 7200},
+				{time.Date(2026, 10, 25, 1, 0, 0, 0, time.UTC), 3600},
+			},
+		},
+		{
+			name: "BYMONTHDAY",
+			body: vtimezoneMonthDay,
+			tzid: "Test Eastern",
+			checks: []struct {
+				utc    time.Time
+				offset int
+			}{
+				// Spring switch 2026-03-08 02:00 EST, autumn switch 2026-11-01 02:00 EDT
+				{time.Date(2026, 3, 8, 6, 59, 59, 0, time.UTC), -5 * 3600},
+				{time.Date(2026, 3, 8, 7, 0, 0, 0, time.UTC), -4 * 3600},
+				{time.Date(2026, 11, 1, 5, 59, 59, 0, time.UTC), -4 * 3600},
+				{time.Date(2026, 11, 1, 6, 0, 0, 0, time.UTC), -5 * 3600},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules := parseVTimezones(test.body)[test.tzid]
+			if rules == nil {
+				t.Fatalf("VTIMEZONE %s was not parsed", test.tzid)
+			}
+			loc, err := buildVTimezoneLocation(test.tzid, rules["STANDARD"], rules["DAYLIGHT"])
+			if err != nil {
+				t.Fatalf("buildVTimezoneLocation returned error: %v", err)
+			}
+			for _, check := range test.checks {
+				if _, offset := check.utc.In(loc).Zone(); offset != check.offset {
+					t.Errorf("offset at %s = %d, want %d", check.utc.Format(time.RFC3339), offset, check.offset)
+				}
+			}
+		})
+	}
+}
+
+func TestFeedTimezoneFallback(t *testing.T) {
+	zones := feedTimezones(context.Background(), vtimezoneLastWeek)
+	loc, err := resolveTZID(`"Test Central Europe"`, zones)
+	if err != nil {
+		t.Fatalf("resolveTZID of a feed timezone returned error: %v", err)
+	}
+	if _, offset := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC).In(loc).Zone(); offset != 7200 {
+		t.Errorf("summer offset = %d, want 7200", offset)
+	}
+	// The VTIMEZONEs of one feed are not used for another
+	if _, err := resolveTZID("Test Central Europe", nil); err == nil {
+		t.Error("resolveTZID of a timezone from another feed returned no error")
+	}
+}
+
+// feedWithZone is a feed defining the fixed offset zone Test Office with one event at 09:00 in it
+func feedWithZone(offset string) string {
+	return "BEGIN:VCALENDAR\r\nBEGIN:VTIMEZONE\r\nTZID:Test Office\r\nBEGIN:STANDARD\r\nDTSTART:16010101T000000\r\n" +
+		"TZOFFSETFROM:" + offset + "\r\nTZOFFSETTO:" + offset + "\r\nEND:STANDARD\r\nEND:VTIMEZONE\r\n" +
+		"BEGIN:VEVENT\r\nUID:office\r\nDTSTAMP:20261001T000000Z\r\nDTSTART;TZID=Test Office:20261102T090000\r\nDTEND;TZID=Test Office:20261102T100000\r\n" +
+		"END:VEVENT\r\nEND:VCALENDAR\r\n"
+}
+
+func TestParseCalendarFeedTimezones(t *testing.T) {
+	// Two feeds define the same TZID differently, each is parsed with its own definition
+	start, end := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 3, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		offset string
+		want   time.Time
+	}{
+		{"+0100", time.Date(2026, 11, 2, 8, 0, 0, 0, time.UTC)},
+		{"-0500", time.Date(2026, 11, 2, 14, 0, 0, 0, time.UTC)},
+	} {
+		events, err := parseCalendar(context.Background(), feedWithZone(test.offset), start, end)
+		if err != nil {
+			t.Fatalf("parseCalendar returned error: %v", err)
+		}
+		if len(events) != 1 || !events[0].Start.Equal(test.want) {
+			t.Errorf("feed with offset %s: events = %v, want one starting at %s", test.offset, events, test.want)
+		}
+	}
+}
+
+func TestTzifWithFooter(t *testing.T) {
+	loc, err := time.LoadLocationFromTZData("Test", tzifWithFooter(3600, "<CET>", "<CET>-1:00:00<CEST>-2:00:00,M3.5.0/02:00:00,M10.5.0/03:00:00"))
+	if err != nil {
+		t.Fatalf("LoadLocationFromTZData returned error: %v", err)
+	}
+	for _, check := range []struct {
+		utc    time.Time
+		name   string
+		offset int
+	}{
+		{time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC), "CET", 3600},
+		{time.Date(2026, 7, 15, 12, 0, 0, 0, time.UTC), "CEST", 7200},
+	} {
+		if name, offset := check.utc.In(loc).Zone(); name != check.name || offset != check.offset {
+			t.Errorf("zone at %s = %s %d, want %s %d", check.utc.Format(time.RFC3339), name, offset, check.name, check.offset)
+		}
+	}
+}
@@ -1,35 +1,366 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/robfig/cron/v3"
 	"gopkg.in/yaml.v3"
 )
 
+// Config holds every setting, each field can be overridden by an env variable, see applyEnvOverrides
 type Config struct {
-	ICS   ICSConfig    `yaml:"ICS"`
-	Email MailSettings `yaml:"Email"`
+	EXPO     EXPOSettings   `yaml:"EXPO"`
+	SMTP     SMTPConfig     `yaml:"SMTP"`
+	Storage  StorageConfig  `yaml:"Storage"`
+	ICS      ICSConfig      `yaml:"ICS"`
+	Email    MailSettings   `yaml:"Email"`
+	DryRun   DryRunConfig   `yaml:"DryRun"`
+	Health   HealthConfig   `yaml:"Health"`
+	Log      LogConfig      `yaml:"Log"`
+	Reload   ReloadConfig   `yaml:"Reload"`
+	Run      RunConfig      `yaml:"Run"`
+	Schedule ScheduleConfig `yaml:"Schedule"`
+	Server   ServerConfig   `yaml:"Server"`
+}
+
+// EXPOSettings is the EXPO instance the bookings are read from, usually set with BOOKINGHANDLER_EXPO_URL and
+// BOOKINGHANDLER_EXPO_TOKEN
+type EXPOSettings struct {
+	Name  string `yaml:"Name"`  // Name of a source, ICS.Calendars[].EXPOSource refers to it
+	URL   string `yaml:"URL"`   // Base URL of the booking site, like https://booking.yourdomain.com
+	Token Secret `yaml:"Token"` // API token
+	// Replaces the booking query compiled into the binary, it has to select the same fields
+	QueryFile string         `yaml:"QueryFile"`
+	Filters   BookingFilters `yaml:"Filters"`
+	// Bookings crossing the edges of the checked window are found if their events are not longer, default 24h,
+	// negative only fetches events completely inside the window
+	MaxEventDuration time.Duration    `yaml:"MaxEventDuration"`
+	Sync             SyncConfig       `yaml:"Sync"`
+	Pagination       PaginationConfig `yaml:"Pagination"`
+	// Several EXPO installations, like one per venue. A source uses the settings above for the ones it leaves out
+	Sources []EXPOSettings `yaml:"Sources"`
+}
+
+// Instances returns the EXPO installations the bookings are read from: the Sources, or the EXPO block itself
+func (expo EXPOSettings) Instances() []EXPOSettings {
+	if len(expo.Sources) == 0 {
+		return []EXPOSettings{expo}
+	}
+	return expo.Sources
+}
+
+// inherit fills the settings a source leaves out from the EXPO block
+func (source *EXPOSettings) inherit(block EXPOSettings) {
+	if source.URL == "" {
+		source.URL = block.URL
+	}
+	if source.Token.Value == "" {
+		source.Token = block.Token
+	}
+	if source.QueryFile == "" {
+		source.QueryFile = block.QueryFile
+	}
+	if len(source.Filters.States) == 0 {
+		source.Filters.States = block.Filters.States
+	}
+	for _, filter := range []struct{ source, block *NameFilter }{
+		{&source.Filters.BookingTypes, &block.Filters.BookingTypes},
+		{&source.Filters.CustomerTypes, &block.Filters.CustomerTypes},
+		{&source.Filters.Offers, &block.Filters.Offers},
+	} {
+		if len(filter.source.Include) == 0 && len(filter.source.Exclude) == 0 {
+			*filter.source = *filter.block
+		}
+	}
+	if source.MaxEventDuration == 0 {
+		source.MaxEventDuration = block.MaxEventDuration
+	}
+	if source.Sync.Mode == "" {
+		source.Sync.Mode = block.Sync.Mode
+	}
+	if source.Sync.FullInterval == 0 {
+		source.Sync.FullInterval = block.Sync.FullInterval
+	}
+	if source.Sync.QueryFile == "" {
+		source.Sync.QueryFile = block.Sync.QueryFile
+	}
+	if source.Pagination.PageSize == 0 {
+		source.Pagination.PageSize = block.Pagination.PageSize
+	}
+	if source.Pagination.MaxPages == 0 {
+		source.Pagination.MaxPages = block.Pagination.MaxPages
+	}
+}
+
+// PaginationConfig limits how the bookings are fetched page by page
+type PaginationConfig struct {
+	// Bookings per page, sent as the first argument of the query, 0 uses the EXPO default
+	PageSize int `yaml:"PageSize"`
+	// A fetch stops after this many pages and the run counts as a partial failure, default 100
+	MaxPages int `yaml:"MaxPages"`
+}
+
+// SyncConfig controls the booking cache of the daemon. Full runs and every FullInterval fetch all bookings in the
+// window, the runs in between only fetch the bookings updated since the last sync
+type SyncConfig struct {
+	Mode         string        `yaml:"Mode"`         // full or incremental, default full
+	FullInterval time.Duration `yaml:"FullInterval"` // Max time between full syncs, default 1h
+	// Replaces the query for updated bookings compiled into the binary, it has to select the same fields
+	QueryFile string `yaml:"QueryFile"`
+}
+
+// BookingFilters decides which EXPO bookings are checked for conflicts, they are applied before the overlap check
+type BookingFilters struct {
+	States        []string   `yaml:"States"` // Booking states that count, like confirmed and preliminary, default confirmed
+	BookingTypes  NameFilter `yaml:"BookingTypes"`
+	CustomerTypes NameFilter `yaml:"CustomerTypes"`
+	Offers        NameFilter `yaml:"Offers"` // Reservations of other offers are ignored, a booking without any left is skipped
+}
+
+// NameFilter matches names with patterns like "School*" without case, an empty Include matches every name
+type NameFilter struct {
+	Include []string `yaml:"Include"`
+	Exclude []string `yaml:"Exclude"`
+}
+
+// Matches reports if name is included and not excluded
+func (filter NameFilter) Matches(name string) bool {
+	included := len(filter.Include) == 0
+	for _, pattern := range filter.Include {
+		if matchName(pattern, name) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range filter.Exclude {
+		if matchName(pattern, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchName(pattern string, name string) bool {
+	matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name))
+	return matched
+}
+
+// IncludesState reports if bookings in state count
+func (filters BookingFilters) IncludesState(state string) bool {
+	for _, included := range filters.States {
+		if strings.EqualFold(included, state) {
+			return true
+		}
+	}
+	return false
+}
+
+// SMTPConfig is the server emails and health alerts are sent through, required when SendEmails is on
+type SMTPConfig struct {
+	Host     string `yaml:"Host"`
+	Port     int    `yaml:"Port"` // Default 587
+	Username string `yaml:"Username"`
+	Password Secret `yaml:"Password"`
+}
+
+// StorageConfig is where the state is kept between runs and restarts
+type StorageConfig struct {
+	DataDir string `yaml:"DataDir"` // sent_emails.txt, state.json, the lock and the dry run report, default /app/data
+}
+
+// DryRunConfig writes the conflicts to a report instead of emailing them, sent_emails.txt is left untouched
+type DryRunConfig struct {
+	Enabled bool   `yaml:"Enabled"`
+	Format  string `yaml:"Format"` // json, csv or html, default json
+	Path    string `yaml:"Path"`   // Where the report is written, default conflict-report.<format> in Storage.DataDir
+}
+
+// ReloadConfig controls how changes to config.yaml are picked up without a restart, SIGHUP always reloads
+type ReloadConfig struct {
+	Interval time.Duration `yaml:"Interval"` // How often config.yaml is checked for changes, default 10s, negative turns it off
+}
+
+// LogConfig controls the log output
+type LogConfig struct {
+	Level  string `yaml:"Level"`  // trace, debug, info, warn or error, default debug
+	Format string `yaml:"Format"` // json or console, default json
+}
+
+// ServerConfig is the HTTP server with the /healthz, /readyz, /status and /metrics endpoints
+type ServerConfig struct {
+	Address string `yaml:"Address"` // Listen address, default :8080
+}
+
+// ScheduleConfig decides when checks run, if Cron, Windows and Every are empty a check runs every Interval
+type ScheduleConfig struct {
+	Interval time.Duration    `yaml:"Interval"` // Default 30m, the Interval env variable sets it in seconds
+	Cron     []string         `yaml:"Cron"`     // Standard 5 field cron expressions, a check runs whenever any of them match
+	Windows  []ScheduleWindow `yaml:"Windows"`  // Periods with their own interval, like business hours
+	Every    time.Duration    `yaml:"Every"`    // Interval outside the windows, 0 means no checks outside the windows
+	Holidays []string         `yaml:"Holidays"` // Dates (2006-01-02) without any checks
+	Tiers    []TierConfig     `yaml:"Tiers"`    // Extra checks of the near future, on top of the full checks above
+
+	Crons []cron.Schedule `yaml:"-"` // Parsed from Cron when the config is loaded
+}
+
+// TierConfig checks the next Horizon more often than the full window, like the next 48 hours every 5 minutes
+type TierConfig struct {
+	Name    string        `yaml:"Name"`
+	Horizon time.Duration `yaml:"Horizon"`
+	Every   time.Duration `yaml:"Every"`
+}
+
+type ScheduleWindow struct {
+	Days  []string      `yaml:"Days"` // Weekdays like Mon or Monday, empty means every day
+	From  string        `yaml:"From"` // Start time like 07:00
+	To    string        `yaml:"To"`   // End time like 18:00
+	Every time.Duration `yaml:"Every"`
+
+	// Parsed from Days, From and To when the config is loaded
+	Weekdays []time.Weekday `yaml:"-"` // Empty means every day
+	Start    time.Duration  `yaml:"-"` // Offset from midnight
+	End      time.Duration  `yaml:"-"`
+}
+
+// IsEmpty reports if no schedule is configured
+func (schedule ScheduleConfig) IsEmpty() bool {
+	return len(schedule.Cron) == 0 && len(schedule.Windows) == 0 && schedule.Every == 0
+}
+
+// RunConfig controls a single check run
+type RunConfig struct {
+	Timeout     time.Duration `yaml:"Timeout"`     // Max duration of a run, default 10m
+	OnOverlap   string        `yaml:"OnOverlap"`   // What to do when a run is due while one is still running: skip or queue, default skip
+	MailTimeout time.Duration `yaml:"MailTimeout"` // Max duration of sending one email, default 1m
+}
+
+// HealthConfig controls the alerts sent when a calendar stops working, like an expired Outlook link
+type HealthConfig struct {
+	AdminEmail        MailAddress   `yaml:"AdminEmail"`        // Alerts are only sent if an address is set
+	AlertAfter        time.Duration `yaml:"AlertAfter"`        // How long a calendar can be unhealthy before alerting, default 2h
+	ZeroEventsAnomaly bool          `yaml:"ZeroEventsAnomaly"` // Count a calendar as unhealthy if it suddenly returns no events
 }
 
 type ICSConfig struct {
-	Calendars []CalendarConfig `yaml:"Calendars"`
+	Calendars     []CalendarConfig `yaml:"Calendars"`
+	ConflictRules ConflictRules    `yaml:"ConflictRules"`
+	Fetch         FetchConfig      `yaml:"Fetch"`
+	// Maps ICS TZIDs to IANA names, checked before the built-in Windows timezone table
+	TimezoneMappings map[string]string `yaml:"TimezoneMappings"`
+}
+
+type FetchConfig struct {
+	Timeout     time.Duration `yaml:"Timeout"`     // Timeout for a whole calendar download, default 30s
+	MaxBodySize int64         `yaml:"MaxBodySize"` // Max calendar size in bytes, default 10 MiB
+	Workers     int           `yaml:"Workers"`     // How many calendars are fetched at the same time, default 4
+}
+
+// ConflictRules decides which ICS events count as a conflict with an EXPO booking.
+// Events without a STATUS or busy-status always count.
+type ConflictRules struct {
+	Statuses           []string `yaml:"Statuses"`           // STATUS values that count, default CONFIRMED and TENTATIVE
+	BusyStatuses       []string `yaml:"BusyStatuses"`       // X-MICROSOFT-CDO-BUSYSTATUS values that count, default BUSY and OOF
+	IncludeTransparent bool     `yaml:"IncludeTransparent"` // Also count TRANSP:TRANSPARENT (free) events
 }
 
 type CalendarConfig struct {
-	Name             string `yaml:"Name"`
-	URL              string `yaml:"URL"`
-	EXPOResourceName string `yaml:"EXPOResourceName"`
+	Name             string       `yaml:"Name"`
+	URL              string       `yaml:"URL"`
+	EXPOResourceName string       `yaml:"EXPOResourceName"`
+	EXPOSource       string       `yaml:"EXPOSource"` // Name of the EXPO source with the resource, needed with several sources
+	Auth             CalendarAuth `yaml:"Auth"`
+}
+
+// CalendarAuth holds the optional credentials for private ICS feeds
+type CalendarAuth struct {
+	Username       string            `yaml:"Username"` // HTTP basic auth, used together with Password
+	Password       Secret            `yaml:"Password"`
+	BearerToken    Secret            `yaml:"BearerToken"`
+	Headers        map[string]Secret `yaml:"Headers"`        // Custom headers like an API key
+	ClientCertFile string            `yaml:"ClientCertFile"` // PEM client certificate for mutual TLS
+	ClientKeyFile  string            `yaml:"ClientKeyFile"`
+	CAFile         string            `yaml:"CAFile"` // Extra PEM CA to trust for the calendar server
+}
+
+// Secret is read from an env variable or a file, so it does not have to be written in config.yaml
+type Secret struct {
+	Env   string `yaml:"Env"`
+	File  string `yaml:"File"`
+	Value string `yaml:"-"` // Resolved when the config is loaded
+}
+
+func (secret *Secret) resolve() error {
+	switch {
+	case secret.Env != "" && secret.File != "":
+		return fmt.Errorf("only one of Env and File can be set")
+	case secret.Env != "":
+		secret.Value = os.Getenv(secret.Env)
+		if secret.Value == "" {
+			return fmt.Errorf("env variable %s not set or empty", secret.Env)
+		}
+	case secret.File != "":
+		buf, err := os.ReadFile(secret.File)
+		if err != nil {
+			return fmt.Errorf("failed to read secret file: %w", err)
+		}
+		secret.Value = strings.TrimSpace(string(buf))
+	}
+	return nil
+}
+
+func (auth *CalendarAuth) resolve() error {
+	if err := auth.Password.resolve(); err != nil {
+		return fmt.Errorf("password: %w", err)
+	}
+	if err := auth.BearerToken.resolve(); err != nil {
+		return fmt.Errorf("bearer token: %w", err)
+	}
+	for name, header := range auth.Headers {
+		if err := header.resolve(); err != nil {
+			return fmt.Errorf("header %s: %w", name, err)
+		}
+		auth.Headers[name] = header
+	}
+	if auth.Username != "" && auth.BearerToken.Value != "" {
+		return fmt.Errorf("only one of basic auth and bearer token can be set")
+	}
+	if (auth.ClientCertFile == "") != (auth.ClientKeyFile == "") {
+		return fmt.Errorf("both ClientCertFile and ClientKeyFile must be set for a client certificate")
+	}
+	return nil
 }
 
 type MailSettings struct {
 	SendEmails          bool          `yaml:"SendEmails"`
 	MailContent         string        `yaml:"MailContent"`
-	MailContentFallback string        `yaml:"MailContentFallback"`
+	MailContentFallback string        `yaml:"MailContentFallback"` // Sent to FallbackEmail, MailContent when not set
 	Mappings            []MailMapping `yaml:"Mappings"`
 	FallbackEmail       MailAddress   `yaml:"FallbackEmail"`
 	From                MailAddress   `yaml:"From"`
 	Subject             string        `yaml:"Subject"`
+	// Used instead of Subject and MailContent for preliminary bookings, when EXPO.Filters.States includes them
+	SubjectPreliminary     string `yaml:"SubjectPreliminary"`
+	MailContentPreliminary string `yaml:"MailContentPreliminary"`
+}
+
+// FallbackContent is the template of the email to FallbackEmail
+func (settings MailSettings) FallbackContent() string {
+	if settings.MailContentFallback != "" {
+		return settings.MailContentFallback
+	}
+	return settings.MailContent
 }
 
 type MailMapping struct {
@@ -42,25 +373,400 @@ type MailAddress struct {
 	Name    string `yaml:"Name"`
 }
 
+// Load reads and validates config.yaml. Unknown keys and invalid values are all reported together, each with its line
 func Load(filePath string) (*Config, error) {
 	buf, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	var config Config
-	if err = yaml.Unmarshal(buf, &config); err != nil {
+	var root yaml.Node
+	if err = yaml.Unmarshal(buf, &root); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config file: %w", err)
 	}
-	// Check if we have any calendars to check
-	if len(config.ICS.Calendars) == 0 {
-		return nil, fmt.Errorf("no ICS configurations found in the config file")
-	}
-	if config.Email.FallbackEmail.Address == "" {
-		return nil, fmt.Errorf("fallback email address is not set in the config file")
+	problems := &problems{root: &root}
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(buf))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		// Type errors, like unknown keys, still decode the rest of the file, so it can be checked too
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("failed to unmarshal config file: %w", err)
+		}
+		problems.errs = append(problems.errs, typeErr.Errors...)
 	}
-	if config.Email.From.Address == "" {
-		return nil, fmt.Errorf("from email address is not set in the config file")
+	resolveSecrets(&config, problems)
+	applyEnvOverrides(&config, problems)
+	checkEXPOSources(&config.EXPO, problems)
+	checkSMTP(&config.SMTP, config.Email.SendEmails, problems)
+	checkSchedule(&config.Schedule, problems)
+	checkICS(&config.ICS, config.EXPO.Instances(), problems)
+	checkEmail(&config.Email, problems)
+	checkHealth(&config.Health, problems)
+	checkOutput(&config, problems)
+	checkRun(&config, problems)
+	if len(problems.errs) > 0 {
+		return nil, problems
 	}
 	return &config, nil
 }
+
+// resolveSecrets reads the EXPO tokens and the SMTP password, the calendar secrets are read with their calendar
+func resolveSecrets(config *Config, problems *problems) {
+	if err := config.EXPO.Token.resolve(); err != nil {
+		problems.add("EXPO.Token", "%v", err)
+	}
+	for i := range config.EXPO.Sources {
+		if err := config.EXPO.Sources[i].Token.resolve(); err != nil {
+			problems.add(fmt.Sprintf("EXPO.Sources[%d].Token", i), "%v", err)
+		}
+	}
+	if err := config.SMTP.Password.resolve(); err != nil {
+		problems.add("SMTP.Password", "%v", err)
+	}
+}
+
+// checkEXPOSources checks the EXPO block, or every source after filling in what it leaves out from the block
+func checkEXPOSources(expo *EXPOSettings, problems *problems) {
+	if len(expo.Sources) == 0 {
+		checkEXPO(expo, "EXPO", problems)
+	}
+	sourceNames := make(map[string]int)
+	for i := range expo.Sources {
+		source := &expo.Sources[i]
+		path := fmt.Sprintf("EXPO.Sources[%d]", i)
+		if source.Name == "" {
+			problems.add(path+".Name", "must be set")
+		} else if first, ok := sourceNames[strings.ToLower(source.Name)]; ok {
+			problems.add(path+".Name", "duplicate source name %q, also used by source %d", source.Name, first+1)
+		} else {
+			sourceNames[strings.ToLower(source.Name)] = i
+		}
+		if len(source.Sources) > 0 {
+			problems.add(path+".Sources", "a source can not have sources")
+		}
+		source.inherit(*expo)
+		checkEXPO(source, path, problems)
+	}
+}
+
+// checkSMTP applies the default port, the credentials are checked when emails are sent so they stop the start
+// instead of failing the first email
+func checkSMTP(smtp *SMTPConfig, sendEmails bool, problems *problems) {
+	if smtp.Port == 0 {
+		smtp.Port = 587
+	} else if smtp.Port < 0 || smtp.Port > 65535 {
+		problems.add("SMTP.Port", "invalid port %d", smtp.Port)
+	}
+	if !sendEmails {
+		return
+	}
+	if smtp.Host == "" {
+		problems.add("SMTP.Host", "must be set when emails are sent, here or with BOOKINGHANDLER_SMTP_HOST")
+	}
+	if smtp.Username == "" {
+		problems.add("SMTP.Username", "must be set when emails are sent, here or with BOOKINGHANDLER_SMTP_USERNAME")
+	}
+	if smtp.Password.Value == "" {
+		problems.add("SMTP.Password", "must be set when emails are sent, here or with BOOKINGHANDLER_SMTP_PASSWORD or BOOKINGHANDLER_SMTP_PASSWORD_FILE")
+	}
+}
+
+// checkICS checks the calendars against the EXPO sources and applies the fetch and conflict rule defaults
+func checkICS(ics *ICSConfig, instances []EXPOSettings, problems *problems) {
+	if len(ics.Calendars) == 0 {
+		problems.add("ICS.Calendars", "no ICS configurations found in the config file")
+	}
+	calendarNames := make(map[string]int)
+	for i := range ics.Calendars {
+		calendar := &ics.Calendars[i]
+		path := fmt.Sprintf("ICS.Calendars[%d]", i)
+		if calendar.Name == "" {
+			problems.add(path+".Name", "must be set")
+		} else if first, ok := calendarNames[strings.ToLower(calendar.Name)]; ok {
+			problems.add(path+".Name", "duplicate calendar name %q, also used by calendar %d", calendar.Name, first+1)
+		} else {
+			calendarNames[strings.ToLower(calendar.Name)] = i
+		}
+		if parsed, err := url.Parse(calendar.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			// The URL holds the calendar secret, so it is not part of the message
+			problems.add(path+".URL", "must be a http or https URL")
+		}
+		if calendar.EXPOResourceName == "" {
+			problems.add(path+".EXPOResourceName", "must be set")
+		}
+		// Set to the name of the source, so the calendars of a source are found by comparing names
+		if calendar.EXPOSource == "" && len(instances) > 1 {
+			problems.add(path+".EXPOSource", "must be set to the name of one of the EXPO.Sources")
+		} else if calendar.EXPOSource == "" {
+			calendar.EXPOSource = instances[0].Name
+		} else if index := slices.IndexFunc(instances, func(source EXPOSettings) bool { return strings.EqualFold(source.Name, calendar.EXPOSource) }); index >= 0 {
+			calendar.EXPOSource = instances[index].Name
+		} else {
+			problems.add(path+".EXPOSource", "unknown EXPO source %q", calendar.EXPOSource)
+		}
+		if err := calendar.Auth.resolve(); err != nil {
+			problems.add(path+".Auth", "%v", err)
+		}
+	}
+	// Default conflict rules, cancelled events never count
+	if len(ics.ConflictRules.Statuses) == 0 {
+		ics.ConflictRules.Statuses = []string{"CONFIRMED", "TENTATIVE"}
+	}
+	if len(ics.ConflictRules.BusyStatuses) == 0 {
+		ics.ConflictRules.BusyStatuses = []string{"BUSY", "OOF"}
+	}
+	for tzid, iana := range ics.TimezoneMappings {
+		if _, err := time.LoadLocation(iana); err != nil {
+			problems.add("ICS.TimezoneMappings", "timezone mapping for %s: %v", tzid, err)
+		}
+	}
+	if ics.Fetch.Timeout <= 0 {
+		ics.Fetch.Timeout = 30 * time.Second
+	}
+	if ics.Fetch.Workers <= 0 {
+		ics.Fetch.Workers = 4
+	}
+	if ics.Fetch.MaxBodySize <= 0 {
+		ics.Fetch.MaxBodySize = 10 << 20
+	}
+}
+
+// checkEmail checks the addresses, templates and summary mappings of the conflict emails
+func checkEmail(email *MailSettings, problems *problems) {
+	if email.FallbackEmail.Address == "" {
+		problems.add("Email.FallbackEmail.Address", "fallback email address is not set in the config file")
+	} else {
+		problems.checkAddress("Email.FallbackEmail.Address", email.FallbackEmail.Address)
+	}
+	if email.From.Address == "" {
+		problems.add("Email.From.Address", "from email address is not set in the config file")
+	} else {
+		problems.checkAddress("Email.From.Address", email.From.Address)
+	}
+	problems.checkTemplate("Email.MailContent", email.MailContent)
+	if email.MailContentFallback != "" {
+		problems.checkTemplate("Email.MailContentFallback", email.MailContentFallback)
+	}
+	if email.MailContentPreliminary != "" {
+		problems.checkTemplate("Email.MailContentPreliminary", email.MailContentPreliminary)
+	}
+	// Summaries are matched without case and spaces, so mappings that only differ in those are duplicates
+	summaries := make(map[string]int)
+	for i, mapping := range email.Mappings {
+		path := fmt.Sprintf("Email.Mappings[%d]", i)
+		summary := strings.ToLower(strings.ReplaceAll(mapping.IcsSummary, " ", ""))
+		if summary == "" {
+			problems.add(path+".icsSummary", "must be set")
+		} else if first, ok := summaries[summary]; ok {
+			problems.add(path+".icsSummary", "duplicate mapping for %q, also mapped by mapping %d", mapping.IcsSummary, first+1)
+		} else {
+			summaries[summary] = i
+		}
+		problems.checkAddress(path+".address", mapping.Address)
+	}
+}
+
+func checkHealth(health *HealthConfig, problems *problems) {
+	if health.AdminEmail.Address != "" {
+		problems.checkAddress("Health.AdminEmail.Address", health.AdminEmail.Address)
+	}
+	if health.AlertAfter <= 0 {
+		health.AlertAfter = 2 * time.Hour
+	}
+}
+
+// checkOutput checks the format of the dry run report and the logs
+func checkOutput(config *Config, problems *problems) {
+	switch strings.ToLower(config.DryRun.Format) {
+	case "":
+		config.DryRun.Format = "json"
+	case "json", "csv", "html":
+		config.DryRun.Format = strings.ToLower(config.DryRun.Format)
+	default:
+		problems.add("DryRun.Format", "invalid format %s, must be json, csv or html", config.DryRun.Format)
+	}
+	switch strings.ToLower(config.Log.Level) {
+	case "":
+		config.Log.Level = "debug"
+	case "trace", "debug", "info", "warn", "error":
+		config.Log.Level = strings.ToLower(config.Log.Level)
+	default:
+		problems.add("Log.Level", "invalid level %s, must be trace, debug, info, warn or error", config.Log.Level)
+	}
+	switch strings.ToLower(config.Log.Format) {
+	case "":
+		config.Log.Format = "json"
+	case "json", "console":
+		config.Log.Format = strings.ToLower(config.Log.Format)
+	default:
+		problems.add("Log.Format", "invalid format %s, must be json or console", config.Log.Format)
+	}
+}
+
+// checkRun applies the defaults of the daemon: runs, the HTTP server, reloading and the data directory
+func checkRun(config *Config, problems *problems) {
+	if config.Storage.DataDir == "" {
+		config.Storage.DataDir = "/app/data"
+	}
+	if config.Server.Address == "" {
+		config.Server.Address = ":8080"
+	}
+	if config.Run.Timeout <= 0 {
+		config.Run.Timeout = 10 * time.Minute
+	}
+	if config.Run.MailTimeout <= 0 {
+		config.Run.MailTimeout = time.Minute
+	}
+	switch strings.ToLower(config.Run.OnOverlap) {
+	case "":
+		config.Run.OnOverlap = "skip"
+	case "skip", "queue":
+		config.Run.OnOverlap = strings.ToLower(config.Run.OnOverlap)
+	default:
+		problems.add("Run.OnOverlap", "invalid value %s, must be skip or queue", config.Run.OnOverlap)
+	}
+	if config.Reload.Interval == 0 {
+		config.Reload.Interval = 10 * time.Second
+	}
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// checkSchedule parses the cron expressions, windows and holidays of the schedule and checks the tiers
+func checkSchedule(schedule *ScheduleConfig, problems *problems) {
+	if schedule.Interval == 0 {
+		schedule.Interval = 30 * time.Minute
+	} else if schedule.Interval < 0 {
+		problems.add("Schedule.Interval", "must be positive")
+	}
+	schedule.Crons = nil
+	for i, expression := range schedule.Cron {
+		parsed, err := cron.ParseStandard(expression)
+		if err != nil {
+			problems.add(fmt.Sprintf("Schedule.Cron[%d]", i), "invalid cron expression %q: %v", expression, err)
+			continue
+		}
+		schedule.Crons = append(schedule.Crons, parsed)
+	}
+	if schedule.Every < 0 {
+		problems.add("Schedule.Every", "must be positive")
+	}
+	for i := range schedule.Windows {
+		window := &schedule.Windows[i]
+		field := fmt.Sprintf("Schedule.Windows[%d]", i)
+		window.Weekdays = nil
+		for _, day := range window.Days {
+			key := strings.ToLower(strings.TrimSpace(day))
+			if len(key) > 3 {
+				key = key[:3]
+			}
+			weekday, ok := weekdays[key]
+			if !ok {
+				problems.add(field+".Days", "invalid day %s, expected a weekday like Mon or Monday", day)
+				continue
+			}
+			window.Weekdays = append(window.Weekdays, weekday)
+		}
+		var fromErr, toErr error
+		if window.Start, fromErr = parseClock(window.From); fromErr != nil {
+			problems.add(field+".From", "%v", fromErr)
+		}
+		if window.End, toErr = parseClock(window.To); toErr != nil {
+			problems.add(field+".To", "%v", toErr)
+		}
+		if fromErr == nil && toErr == nil && window.End <= window.Start {
+			problems.add(field+".To", "must be after From")
+		}
+		if window.Every <= 0 {
+			problems.add(field+".Every", "must be set")
+		}
+	}
+	for i, holiday := range schedule.Holidays {
+		if _, err := time.Parse(time.DateOnly, holiday); err != nil {
+			problems.add(fmt.Sprintf("Schedule.Holidays[%d]", i), "invalid date %q, expected YYYY-MM-DD", holiday)
+		}
+	}
+	for i, tier := range schedule.Tiers {
+		if tier.Horizon <= 0 || tier.Every <= 0 {
+			problems.add(fmt.Sprintf("Schedule.Tiers[%d]", i), "Horizon and Every must be set")
+		}
+		if tier.Name == "" {
+			schedule.Tiers[i].Name = "next " + tier.Horizon.String()
+		}
+	}
+}
+
+// parseClock parses a time of day like 07:00, 24:00 is allowed as the end of the day
+func parseClock(value string) (time.Duration, error) {
+	if value == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// checkEXPO validates the settings of the EXPO block or the source at field and applies the defaults
+func checkEXPO(expo *EXPOSettings, field string, problems *problems) {
+	// The env variables only set the EXPO block, a source gets the value from there
+	where := func(env string) string {
+		if field == "EXPO" {
+			return "with " + env
+		}
+		return "in the EXPO block"
+	}
+	if parsed, err := url.Parse(expo.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		problems.add(field+".URL", "must be a http or https URL, set it here or %s", where("BOOKINGHANDLER_EXPO_URL"))
+	} else {
+		expo.URL = strings.TrimSuffix(expo.URL, "/")
+	}
+	if expo.Token.Value == "" {
+		problems.add(field+".Token", "must be set, here or %s", where("BOOKINGHANDLER_EXPO_TOKEN or BOOKINGHANDLER_EXPO_TOKEN_FILE"))
+	}
+	if expo.MaxEventDuration == 0 {
+		expo.MaxEventDuration = 24 * time.Hour
+	}
+	switch strings.ToLower(expo.Sync.Mode) {
+	case "":
+		expo.Sync.Mode = "full"
+	case "incremental", "full":
+		expo.Sync.Mode = strings.ToLower(expo.Sync.Mode)
+	default:
+		problems.add(field+".Sync.Mode", "invalid mode %s, must be full or incremental", expo.Sync.Mode)
+	}
+	if expo.Sync.FullInterval <= 0 {
+		expo.Sync.FullInterval = time.Hour
+	}
+	if expo.Pagination.PageSize < 0 {
+		problems.add(field+".Pagination.PageSize", "must not be negative, 0 uses the EXPO default")
+	}
+	if expo.Pagination.MaxPages == 0 {
+		expo.Pagination.MaxPages = 100
+	} else if expo.Pagination.MaxPages < 0 {
+		problems.add(field+".Pagination.MaxPages", "must be positive")
+	}
+	if len(expo.Filters.States) == 0 {
+		expo.Filters.States = []string{"confirmed"}
+	}
+	for _, filter := range []struct {
+		path   string
+		filter NameFilter
+	}{
+		{field + ".Filters.BookingTypes", expo.Filters.BookingTypes},
+		{field + ".Filters.CustomerTypes", expo.Filters.CustomerTypes},
+		{field + ".Filters.Offers", expo.Filters.Offers},
+	} {
+		for _, pattern := range append(filter.filter.Include, filter.filter.Exclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				problems.add(filter.path, "invalid pattern %q: %v", pattern, err)
+			}
+		}
+	}
+}
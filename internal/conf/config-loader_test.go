@@ -0,0 +1,43 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckEmailFallbackContent(t *testing.T) {
+	email := MailSettings{
+		MailContent:   "<p>{{.Summary}}</p>",
+		FallbackEmail: MailAddress{Address: "admin@example.com"},
+		From:          MailAddress{Address: "booking@example.com"},
+	}
+	problems := &problems{}
+	checkEmail(&email, problems)
+	if len(problems.errs) > 0 {
+		t.Fatalf("problems = %q, want none without MailContentFallback", problems.errs)
+	}
+	if got := email.FallbackContent(); got != email.MailContent {
+		t.Errorf("FallbackContent() = %q, want MailContent", got)
+	}
+
+	email.MailContentFallback = "<p>{{.Sumary}}</p>"
+	checkEmail(&email, problems)
+	if len(problems.errs) != 1 {
+		t.Errorf("problems = %q, want one for the unknown field", problems.errs)
+	}
+}
+
+func TestCheckEXPODefaults(t *testing.T) {
+	expo := EXPOSettings{URL: "https://booking.example.com/", Token: Secret{Value: "token"}}
+	problems := &problems{}
+	checkEXPO(&expo, "EXPO", problems)
+	if len(problems.errs) > 0 {
+		t.Fatalf("problems = %q, want none", problems.errs)
+	}
+	if expo.MaxEventDuration != 24*time.Hour {
+		t.Errorf("MaxEventDuration = %v, want 24h", expo.MaxEventDuration)
+	}
+	if expo.Sync.Mode != "full" {
+		t.Errorf("Sync.Mode = %q, want full", expo.Sync.Mode)
+	}
+}
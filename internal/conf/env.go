@@ -0,0 +1,151 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix starts the name of every env override, so variables other software sets in the container, like the
+// SMTP_PORT=tcp://... a Kubernetes service named smtp adds, are not read as config
+const envPrefix = "BOOKINGHANDLER_"
+
+var (
+	secretType   = reflect.TypeOf(Secret{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// legacyEnv are the names without the prefix from before the overrides covered the whole config. They are
+// only read when the prefixed variable is not set
+var legacyEnv = map[string]bool{
+	"EXPO_URL":      true,
+	"EXPO_TOKEN":    true,
+	"SMTP_HOST":     true,
+	"SMTP_PORT":     true,
+	"SMTP_USERNAME": true,
+	"SMTP_PASSWORD": true,
+}
+
+// applyEnvOverrides lets env variables override any field of the config. The name is envPrefix and the path of
+// the field in upper case joined by _, like BOOKINGHANDLER_EXPO_URL or BOOKINGHANDLER_ICS_FETCH_TIMEOUT.
+// NAME_FILE reads the value from a file instead, like a Docker or Kubernetes secret. Lists are comma
+// separated, lists of blocks and maps can only be set in config.yaml
+func applyEnvOverrides(config *Config, problems *problems) {
+	overrideFields(reflect.ValueOf(config).Elem(), "", problems)
+	// Interval in seconds is the env variable from before the Schedule block
+	_, scheduleInterval, _ := lookupEnv(envPrefix + "SCHEDULE_INTERVAL")
+	if interval := os.Getenv("Interval"); interval != "" && !scheduleInterval {
+		seconds, err := strconv.Atoi(interval)
+		if err != nil {
+			problems.addEnv("Interval", "not a number of seconds: %s", interval)
+		} else {
+			config.Schedule.Interval = time.Duration(seconds) * time.Second
+		}
+	}
+}
+
+// overrideFields sets the fields of value from the env, path is the name of value without envPrefix
+func overrideFields(value reflect.Value, path string, problems *problems) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fieldPath := strings.ToUpper(name)
+		if path != "" {
+			fieldPath = path + "_" + fieldPath
+		}
+		fieldValue := value.Field(i)
+		if field.Type.Kind() == reflect.Struct && field.Type != secretType {
+			overrideFields(fieldValue, fieldPath, problems)
+			continue
+		}
+		env := envPrefix + fieldPath
+		raw, ok, err := lookupEnv(env)
+		if err == nil && !ok {
+			env, raw, ok = lookupLegacyEnv(fieldPath)
+		}
+		if err == nil && ok && field.Type == secretType {
+			fieldValue.Addr().Interface().(*Secret).Value = raw
+			continue
+		}
+		if err == nil && ok {
+			err = setField(fieldValue, raw)
+		}
+		if err != nil {
+			problems.addEnv(env, "%v", err)
+		}
+	}
+}
+
+// lookupEnv reads NAME, or the file NAME_FILE points to with the trailing newline removed
+func lookupEnv(name string) (string, bool, error) {
+	if value := os.Getenv(name); value != "" {
+		return value, true, nil
+	}
+	file := os.Getenv(name + "_FILE")
+	if file == "" {
+		return "", false, nil
+	}
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read %s_FILE: %w", name, err)
+	}
+	return strings.TrimSpace(string(buf)), true, nil
+}
+
+// lookupLegacyEnv reads the variable without the prefix if path is one of legacyEnv
+func lookupLegacyEnv(path string) (string, string, bool) {
+	value := os.Getenv(path)
+	if !legacyEnv[path] || value == "" {
+		return "", "", false
+	}
+	// A Kubernetes service named smtp sets SMTP_PORT to its address, like tcp://10.0.0.1:587
+	if path == "SMTP_PORT" && strings.Contains(value, "://") {
+		return "", "", false
+	}
+	return path, value, true
+}
+
+func setField(field reflect.Value, raw string) error {
+	if field.Type() == durationType {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(parsed)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(parsed)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	}
+	return nil
+}
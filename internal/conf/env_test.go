@@ -0,0 +1,115 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeSecretFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEnvOverridesPrefix(t *testing.T) {
+	t.Setenv("BOOKINGHANDLER_SMTP_HOST", "smtp.example.com")
+	t.Setenv("BOOKINGHANDLER_ICS_FETCH_TIMEOUT", "10s")
+	t.Setenv("BOOKINGHANDLER_SCHEDULE_HOLIDAYS", "2026-12-24, 2026-12-25")
+	t.Setenv("LOG_LEVEL", "error") // Without the prefix and not a legacy name
+	config := Config{Log: LogConfig{Level: "info"}}
+	problems := &problems{}
+	applyEnvOverrides(&config, problems)
+	if len(problems.errs) > 0 {
+		t.Fatalf("problems = %q, want none", problems.errs)
+	}
+	if config.SMTP.Host != "smtp.example.com" {
+		t.Errorf("SMTP.Host = %q, want smtp.example.com", config.SMTP.Host)
+	}
+	if config.ICS.Fetch.Timeout != 10*time.Second {
+		t.Errorf("ICS.Fetch.Timeout = %v, want 10s", config.ICS.Fetch.Timeout)
+	}
+	if got := strings.Join(config.Schedule.Holidays, ","); got != "2026-12-24,2026-12-25" {
+		t.Errorf("Schedule.Holidays = %q, want both dates", got)
+	}
+	if config.Log.Level != "info" {
+		t.Errorf("Log.Level = %q, want the config value", config.Log.Level)
+	}
+}
+
+func TestEnvOverridesLegacyNames(t *testing.T) {
+	t.Setenv("EXPO_URL", "https://legacy.example.com")
+	t.Setenv("BOOKINGHANDLER_EXPO_URL", "https://booking.example.com")
+	t.Setenv("SMTP_USERNAME", "legacy")
+	t.Setenv("SMTP_PORT", "tcp://10.0.0.1:587") // Set by a Kubernetes service named smtp
+	config := Config{SMTP: SMTPConfig{Port: 465}}
+	problems := &problems{}
+	applyEnvOverrides(&config, problems)
+	if len(problems.errs) > 0 {
+		t.Fatalf("problems = %q, want none", problems.errs)
+	}
+	if config.EXPO.URL != "https://booking.example.com" {
+		t.Errorf("EXPO.URL = %q, want the prefixed variable", config.EXPO.URL)
+	}
+	if config.SMTP.Username != "legacy" {
+		t.Errorf("SMTP.Username = %q, want the legacy variable", config.SMTP.Username)
+	}
+	if config.SMTP.Port != 465 {
+		t.Errorf("SMTP.Port = %d, want the config value", config.SMTP.Port)
+	}
+
+	t.Setenv("SMTP_PORT", "2525")
+	applyEnvOverrides(&config, problems)
+	if config.SMTP.Port != 2525 {
+		t.Errorf("SMTP.Port = %d, want the legacy port", config.SMTP.Port)
+	}
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	t.Setenv("BOOKINGHANDLER_EXPO_TOKEN_FILE", writeSecretFile(t, "token\n"))
+	t.Setenv("BOOKINGHANDLER_SMTP_USERNAME_FILE", writeSecretFile(t, "user\n"))
+	t.Setenv("BOOKINGHANDLER_SMTP_PASSWORD_FILE", filepath.Join(t.TempDir(), "missing"))
+	config := Config{}
+	problems := &problems{}
+	applyEnvOverrides(&config, problems)
+	if config.EXPO.Token.Value != "token" {
+		t.Errorf("EXPO.Token = %q, want the file content without the newline", config.EXPO.Token.Value)
+	}
+	if config.SMTP.Username != "user" {
+		t.Errorf("SMTP.Username = %q, want the file content without the newline", config.SMTP.Username)
+	}
+	if len(problems.errs) != 1 || !strings.Contains(problems.errs[0], "BOOKINGHANDLER_SMTP_PASSWORD_FILE") {
+		t.Errorf("problems = %q, want one for the missing password file", problems.errs)
+	}
+}
+
+func TestEnvOverridesLegacyInterval(t *testing.T) {
+	tests := []struct {
+		interval         string
+		scheduleInterval string
+		want             time.Duration
+		wantProblem      bool
+	}{
+		{"1800", "", 30 * time.Minute, false},
+		{"1800", "5m", 5 * time.Minute, false},
+		{"half an hour", "", time.Hour, true},
+	}
+	for _, test := range tests {
+		t.Setenv("Interval", test.interval)
+		t.Setenv("BOOKINGHANDLER_SCHEDULE_INTERVAL", test.scheduleInterval)
+		config := Config{Schedule: ScheduleConfig{Interval: time.Hour}}
+		problems := &problems{}
+		applyEnvOverrides(&config, problems)
+		if config.Schedule.Interval != test.want {
+			t.Errorf("Interval=%s: Schedule.Interval = %v, want %v", test.interval, config.Schedule.Interval, test.want)
+		}
+		if got := len(problems.errs) > 0; got != test.wantProblem {
+			t.Errorf("Interval=%s: problems = %q, want a problem %v", test.interval, problems.errs, test.wantProblem)
+		}
+	}
+}
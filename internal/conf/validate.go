@@ -0,0 +1,118 @@
+package config
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// problems collects the errors found in config.yaml with the line they are on, so all of them are reported at once
+type problems struct {
+	root *yaml.Node
+	errs []string
+}
+
+// add records a problem with the value at path, like ICS.Calendars[1].Name
+func (p *problems) add(path string, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if line := p.line(path); line > 0 {
+		p.errs = append(p.errs, fmt.Sprintf("line %d: %s: %s", line, path, message))
+	} else {
+		p.errs = append(p.errs, fmt.Sprintf("%s: %s", path, message))
+	}
+}
+
+// addEnv records a problem with an env variable, it has no line in config.yaml
+func (p *problems) addEnv(name string, format string, args ...interface{}) {
+	p.errs = append(p.errs, fmt.Sprintf("env %s: %s", name, fmt.Sprintf(format, args...)))
+}
+
+// line finds the line of the value at path, or of its closest parent that is in the file
+func (p *problems) line(path string) int {
+	if p.root == nil || len(p.root.Content) == 0 {
+		return 0
+	}
+	node, line := p.root.Content[0], 0
+	for _, part := range strings.Split(path, ".") {
+		name, index := part, -1
+		if open := strings.Index(part, "["); open >= 0 && strings.HasSuffix(part, "]") {
+			name = part[:open]
+			index, _ = strconv.Atoi(part[open+1 : len(part)-1])
+		}
+		key, value := mappingEntry(node, name)
+		if key == nil {
+			break
+		}
+		node, line = value, key.Line
+		if index >= 0 {
+			if node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+				break
+			}
+			node, line = node.Content[index], node.Content[index].Line
+		}
+	}
+	return line
+}
+
+func mappingEntry(node *yaml.Node, name string) (*yaml.Node, *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == name {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// Error lists every problem on its own line
+func (p *problems) Error() string {
+	return strings.Join(p.errs, "\n")
+}
+
+// Errors returns the problems one by one, used by the validate command
+func (p *problems) Errors() []string {
+	return p.errs
+}
+
+// checkAddress validates an email address, a name like "IT <it@mail.com>" is not allowed since only the address is used
+func (p *problems) checkAddress(path string, address string) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address {
+		p.add(path, "invalid email address %q", address)
+	}
+}
+
+// TemplateData is what the email templates get, the emails are formatted and the templates checked with it,
+// so a template using any other field fails at startup
+type TemplateData struct {
+	Summary     string // Summary of the calendar event
+	Resource    string
+	Start       string // Start and end of the calendar event in RFC 3339
+	End         string
+	BookingURL  string
+	HumanNumber string // Booking number shown in EXPO
+	State       string // Booking state, like confirmed or preliminary
+	Source      string // Name of the EXPO source, empty with a single one
+}
+
+// checkTemplate parses and runs an email template, so mistakes show up at startup instead of when an email is sent
+func (p *problems) checkTemplate(path string, content string) {
+	if strings.TrimSpace(content) == "" {
+		p.add(path, "must be set")
+		return
+	}
+	tmpl, err := template.New("email").Parse(content)
+	if err == nil {
+		err = tmpl.Execute(io.Discard, TemplateData{})
+	}
+	if err != nil {
+		p.add(path, "%v", err)
+	}
+}